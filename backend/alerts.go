@@ -0,0 +1,294 @@
+package main
+
+import (
+	"armorshield/notifier"
+	"armorshield/record"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Severities that alerts can be routed by.
+const (
+	SEVERITY_BLACKLIST = "blacklist"
+	SEVERITY_BOLO      = "bolo"
+	SEVERITY_FREEZE    = "freeze"
+	SEVERITY_MISMATCH  = "mismatch"
+	SEVERITY_CANARY    = "canary"
+)
+
+// How long identical alerts are suppressed for if the project doesn't specify it.
+const DEFAULT_ALERT_WINDOW = 10 * time.Minute
+
+// Maximum length of the reasons in a single digest, leaving room for the template of a route.
+// NB: Discord rejects embeds with a description over 4096 characters.
+const DIGEST_PAGE_SIZE = 3500
+
+// Description used when a route has no template.
+const DEFAULT_ALERT_TEMPLATE = "{{if .Reason}}Reason: {{.Reason}}{{end}}"
+
+// A destination that alerts of a severity are sent to.
+type route struct {
+	kind     string
+	target   string
+	template string
+	mention  bool
+}
+
+// Routes of a project for a severity.
+// NB: Projects without routes fall back to their alert fields for every severity.
+func routes(app *pocketbase.PocketBase, pr *Project, severity string) []route {
+	rrl, err := app.FindRecordsByFilter(
+		"routes",
+		"project = {:projectId}",
+		"", 0, 0, dbx.Params{"projectId": pr.Id},
+	)
+
+	if err == nil && len(rrl) > 0 {
+		rts := []route{}
+
+		for _, rr := range rrl {
+			if sv := rr.GetStringSlice("severities"); len(sv) > 0 && !slices.Contains(sv, severity) {
+				continue
+			}
+
+			rts = append(rts, route{
+				kind:     rr.GetString("kind"),
+				target:   rr.GetString("target"),
+				template: rr.GetString("template"),
+				mention:  rr.GetBool("mention"),
+			})
+		}
+
+		return rts
+	}
+
+	rts := []route{}
+
+	if url := pr.GetString("alertWebhook"); len(url) > 0 {
+		rts = append(rts, route{kind: NOTIFIER_DISCORD, target: url, mention: true})
+	}
+
+	if url := pr.GetString("alertJsonWebhook"); len(url) > 0 {
+		rts = append(rts, route{kind: NOTIFIER_WEBHOOK, target: url})
+	}
+
+	if to := pr.GetString("alertEmail"); len(to) > 0 {
+		rts = append(rts, route{kind: NOTIFIER_SMTP, target: to})
+	}
+
+	return rts
+}
+
+func render(tmpl string, alert *notifier.Alert) (string, error) {
+	if len(tmpl) <= 0 {
+		tmpl = DEFAULT_ALERT_TEMPLATE
+	}
+
+	tp, err := template.New("alert").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	b := bytes.Buffer{}
+	if err := tp.Execute(&b, alert); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Send an alert to every route of it's severity.
+func dispatch(app *pocketbase.PocketBase, pr *Project, alert *notifier.Alert) error {
+	for _, rt := range routes(app, pr, alert.Severity) {
+		ra := *alert
+		ra.Mention = ra.Mention && rt.mention
+
+		desc, err := render(rt.template, &ra)
+		if err != nil {
+			return err
+		}
+
+		ra.Description = desc
+
+		if err := queue(app, pr, rt.kind, rt.target, &ra); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Identifies alerts that are the same for the purpose of suppression.
+func alertFingerprint(alert *notifier.Alert) string {
+	h := sha256.Sum256([]byte(alert.KeyId + "\x00" + alert.Severity + "\x00" + alert.Reason))
+	return hex.EncodeToString(h[:])
+}
+
+func alertWindow(pr *Project) time.Duration {
+	if mins := pr.GetFloat("alertWindow"); mins > 0 {
+		return time.Duration(mins * float64(time.Minute))
+	}
+
+	return DEFAULT_ALERT_WINDOW
+}
+
+// Check if an identical alert was sent recently, counting it for the next digest if so.
+func suppress(app *pocketbase.PocketBase, pr *Project, alert *notifier.Alert) (bool, error) {
+	fp := alertFingerprint(alert)
+
+	ar, _ := app.FindFirstRecordByFilter("alerts", "fingerprint = {:fingerprint}", dbx.Params{"fingerprint": fp})
+	if ar == nil {
+		_, err := record.Create(app, "alerts", map[string]any{
+			"project":     pr.Id,
+			"fingerprint": fp,
+			"key":         alert.KeyId,
+			"severity":    alert.Severity,
+			"reason":      alert.Reason,
+			"lastSent":    types.NowDateTime(),
+			"suppressed":  0,
+		})
+
+		return false, err
+	}
+
+	if time.Since(ar.GetDateTime("lastSent").Time()) > alertWindow(pr) {
+		ar.Set("lastSent", types.NowDateTime())
+		return false, app.Save(ar)
+	}
+
+	ar.Set("suppressed", ar.GetInt("suppressed")+1)
+
+	return true, app.Save(ar)
+}
+
+// Deduplicate and route an alert.
+func notify(app *pocketbase.PocketBase, pr *Project, alert *notifier.Alert) error {
+	suppressed, err := suppress(app, pr, alert)
+	if err != nil {
+		return err
+	}
+
+	if suppressed {
+		return nil
+	}
+
+	return dispatch(app, pr, alert)
+}
+
+// Split the lines of a digest into pages that each fit into a single alert.
+// NB: Lines that don't fit into a page on their own are cut off.
+func digestPages(lines []string) [][]string {
+	pages := [][]string{}
+	page := []string{}
+	size := 0
+
+	for _, line := range lines {
+		if rs := []rune(line); len(rs) > DIGEST_PAGE_SIZE {
+			line = string(rs[:DIGEST_PAGE_SIZE-3]) + "..."
+		}
+
+		length := utf8.RuneCountInString(line) + 1
+
+		if size+length > DIGEST_PAGE_SIZE && len(page) > 0 {
+			pages = append(pages, page)
+			page = []string{}
+			size = 0
+		}
+
+		page = append(page, line)
+		size += length
+	}
+
+	if len(page) > 0 {
+		pages = append(pages, page)
+	}
+
+	return pages
+}
+
+// Send a digest of suppressed alerts per project and severity.
+func digestAlerts(app *pocketbase.PocketBase) error {
+	arl, err := app.FindRecordsByFilter("alerts", "suppressed > 0", "", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	type group struct {
+		project  string
+		severity string
+	}
+
+	groups := map[group][]*core.Record{}
+	for _, ar := range arl {
+		gp := group{project: ar.GetString("project"), severity: ar.GetString("severity")}
+		groups[gp] = append(groups[gp], ar)
+	}
+
+	for gp, ars := range groups {
+		if errs := app.ExpandRecord(ars[0], []string{"project"}, nil); len(errs) > 0 {
+			continue
+		}
+
+		prr := ars[0].ExpandedOne("project")
+		if prr == nil {
+			continue
+		}
+
+		pr := &Project{}
+		pr.SetProxyRecord(prr)
+
+		lines := []string{}
+		total := 0
+
+		for _, ar := range ars {
+			lines = append(lines, fmt.Sprintf("%s (%s) x%d", ar.GetString("key"), ar.GetString("reason"), ar.GetInt("suppressed")))
+			total += ar.GetInt("suppressed")
+		}
+
+		sort.Strings(lines)
+
+		pages := digestPages(lines)
+
+		for idx, page := range pages {
+			title := fmt.Sprintf("Digest of %d suppressed '%s' alerts", total, gp.severity)
+			if len(pages) > 1 {
+				title = fmt.Sprintf("%s (%d/%d)", title, idx+1, len(pages))
+			}
+
+			alert := notifier.Alert{
+				Title:     title,
+				Severity:  gp.severity,
+				Reason:    strings.Join(page, "\n"),
+				Color:     0x808080,
+				Timestamp: time.Now(),
+			}
+
+			if err := dispatch(app, pr, &alert); err != nil {
+				return err
+			}
+		}
+
+		for _, ar := range ars {
+			ar.Set("suppressed", 0)
+
+			if err := app.Save(ar); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+// A bootstrapped app in a temporary data dir, without any of the project's collections.
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir()})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		app.ResetBootstrapState()
+	})
+
+	return app
+}
+
+// Create a collection with the given fields, relations are named after the collection they point to.
+func testCollection(t *testing.T, app *pocketbase.PocketBase, name string, fields ...core.Field) *core.Collection {
+	t.Helper()
+
+	col := core.NewBaseCollection(name)
+	col.Fields.Add(fields...)
+	col.Fields.Add(&core.AutodateField{Name: "created", OnCreate: true})
+
+	if err := app.Save(col); err != nil {
+		t.Fatal(err)
+	}
+
+	return col
+}
+
+// A relation field to a single record of another collection.
+func testRelation(t *testing.T, app *pocketbase.PocketBase, name string, collection string) *core.RelationField {
+	t.Helper()
+
+	col, err := app.FindCollectionByNameOrId(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &core.RelationField{Name: name, CollectionId: col.Id, MaxSelect: 1}
+}
+
+// Create a record or fail the test.
+func testRecord(t *testing.T, app *pocketbase.PocketBase, collection string, data map[string]any) *core.Record {
+	t.Helper()
+
+	col, err := app.FindCollectionByNameOrId(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := core.NewRecord(col)
+	rec.Load(data)
+
+	if err := app.Save(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec
+}
+
+// A protected output to upload into a file field.
+func testFile(t *testing.T, data string) *filesystem.File {
+	t.Helper()
+
+	file, err := filesystem.NewFileFromBytes([]byte(data), "protected.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
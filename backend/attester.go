@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Client state that can be mixed into a challenge.
+const (
+	ATTEST_FIELD_SUB_ID Bitmask = 1 << iota
+	ATTEST_FIELD_SCRIPT_ID
+	ATTEST_FIELD_TIMESTAMP
+)
+
+// A challenge that is waiting for an answer.
+type challenge struct {
+	fields   Bitmask
+	deadline time.Time
+}
+
+// Periodically challenges a loaded subscription to prove it still holds the handshake keys.
+type attester struct {
+	hs     handshaker
+	policy AttestPolicy
+
+	// Pending challenges and it's mutex.
+	mu      sync.Mutex
+	pending map[[16]byte]challenge
+}
+
+func newAttester(hs handshaker, policy AttestPolicy) *attester {
+	return &attester{hs: hs, policy: policy, pending: make(map[[16]byte]challenge)}
+}
+
+// The expected answer to a challenge.
+func (at *attester) answer(sub *subscription, nonce [16]byte, fields Bitmask) []byte {
+	mac := hmac.New(sha256.New, at.hs.hmac[:])
+	mac.Write(nonce[:])
+	mac.Write([]byte{byte(fields)})
+
+	if fields.HasFlag(ATTEST_FIELD_SUB_ID) {
+		mac.Write(sub.uuid[:])
+	}
+
+	if fields.HasFlag(ATTEST_FIELD_SCRIPT_ID) {
+		mac.Write([]byte(sub.script))
+	}
+
+	if fields.HasFlag(ATTEST_FIELD_TIMESTAMP) {
+		mac.Write([]byte(sub.timestamp.UTC().Format(time.RFC3339)))
+	}
+
+	return mac.Sum(nil)
+}
+
+// Send a new randomized challenge.
+func (at *attester) challenge(sub *subscription) error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+
+	fields := Bitmask(mrand.IntN(int(ATTEST_FIELD_TIMESTAMP<<1)-1) + 1)
+	deadline := time.Now().Add(at.policy.Deadline)
+
+	at.mu.Lock()
+	at.pending[nonce] = challenge{fields: fields, deadline: deadline}
+	at.mu.Unlock()
+
+	return at.hs.message(sub, Message{Id: PacketIdAttest, Data: AttestRequest{
+		Nonce:    nonce,
+		Fields:   uint32(fields),
+		Deadline: uint64(deadline.Unix()),
+	}})
+}
+
+// Drop every challenge that went past it's deadline, returning if there were any.
+func (at *attester) expired() bool {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	now := time.Now()
+	missed := false
+
+	for nonce, ch := range at.pending {
+		if ch.deadline.Before(now) {
+			delete(at.pending, nonce)
+			missed = true
+		}
+	}
+
+	return missed
+}
+
+// Time until the next challenge, with jitter so clients can't predict it.
+func (at *attester) next() time.Duration {
+	jitter := time.Duration(mrand.Int64N(int64(at.policy.Interval)/2 + 1))
+	return at.policy.Interval*3/4 + jitter
+}
+
+// NB: This function blocks until the context is done, which an escalation that closes the subscription also does.
+func (at *attester) run(ctx context.Context, sub *subscription) {
+	timer := time.NewTimer(at.next())
+	defer timer.Stop()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if err := at.challenge(sub); err != nil {
+				sub.logger.Error("attestation challenge error", slog.String("error", err.Error()))
+			}
+
+			timer.Reset(at.next())
+		case <-ticker.C:
+			if !at.expired() {
+				continue
+			}
+
+			sub.logger.Warn("attestation challenge missed")
+
+			// NB: Escalating changes the subscription, so leave it to the read loop.
+			sub.dispatch(func() error {
+				return sub.bootstrapper.escalate(sub, at.policy.Action, at.policy.BanDuration, "attestation failed")
+			})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (at *attester) handle(sub *subscription, pk Packet) error {
+	var ar AttestResponse
+	err := at.hs.unmarshal(sub, pk.Msg, &ar)
+	if err != nil {
+		return err
+	}
+
+	at.mu.Lock()
+	ch, ok := at.pending[ar.Nonce]
+	delete(at.pending, ar.Nonce)
+	at.mu.Unlock()
+
+	if !ok {
+		return errors.New("attestation for unknown challenge")
+	}
+
+	if time.Now().After(ch.deadline) || !hmac.Equal(at.answer(sub, ar.Nonce, ch.fields), ar.Mac[:]) {
+		sub.logger.Warn("attestation challenge failed")
+		return sub.bootstrapper.escalate(sub, at.policy.Action, at.policy.BanDuration, "attestation failed")
+	}
+
+	return nil
+}
+
+func (at *attester) packet() byte {
+	return PacketIdAttest
+}
+
+func (at *attester) state(sub *subscription) bool {
+	return sub.state.HasFlag(STATE_LOADED)
+}
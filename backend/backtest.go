@@ -0,0 +1,372 @@
+package main
+
+import (
+	"armorshield/ipintel"
+	"armorshield/universe"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// What to replay and how.
+type BacktestOptions struct {
+	// Only replay subscriptions created after this.
+	Since time.Time
+
+	// Overrides the workspace threshold of every project.
+	// NB: Zero uses the threshold of the project.
+	WorkspaceThreshold float64
+
+	// Maximum amount of subscriptions to replay.
+	// NB: Zero replays every subscription.
+	Limit int
+}
+
+// Checks that can't be replayed from stored records.
+// NB: Fingerprints are stored per key, so only the analytics part of a mismatch is replayed.
+var backtestSkipped = []string{
+	"mismatch: hardware id, exploit and device type are only stored for the first identify of a key",
+	"version: the lua version a subscription reported isn't stored",
+	"integrity: probe results aren't stored",
+}
+
+// Keys that the current rules would newly flag and what couldn't be replayed.
+type BacktestReport struct {
+	Results []*BacktestResult `json:"results"`
+	Skipped []string          `json:"skipped"`
+}
+
+// A key that the current rules would newly flag.
+type BacktestResult struct {
+	KeyId         string   `json:"key"`
+	Subscriptions int      `json:"subscriptions"`
+	Reasons       []string `json:"reasons"`
+}
+
+// Rebuild what a subscription sent when it identified from it's stored records.
+// NB: Fingerprints are stored per key, so they reflect the first identify of the key.
+// Subscriptions from before devices were recorded replay the first analytics of their key, which is reported back.
+func replayRequest(app *pocketbase.PocketBase, kr *Key, sbr *core.Record) (*IdentifyRequest, *core.Record, *core.Record, *core.Record, bool, error) {
+	ir := IdentifyRequest{}
+
+	fr, err := app.FindFirstRecordByFilter("fingerprints", "key = {:keyId}", dbx.Params{"keyId": kr.Id})
+	if err != nil {
+		return nil, nil, nil, nil, false, err
+	}
+
+	ar, err := app.FindFirstRecordByFilter("analytics", "key = {:keyId}", dbx.Params{"keyId": kr.Id})
+	if err != nil {
+		return nil, nil, nil, nil, false, err
+	}
+
+	sr, err := app.FindFirstRecordByFilter("sessions", "subscription = {:sbid}", dbx.Params{"sbid": sbr.Id})
+	if err != nil {
+		return nil, nil, nil, nil, false, err
+	}
+
+	jr, err := app.FindFirstRecordByFilter("joins", "subscription = {:sbid}", dbx.Params{"sbid": sbr.Id})
+	if err != nil {
+		return nil, nil, nil, nil, false, err
+	}
+
+	ir.KeyInfo.FingerprintInfo = FingerprintInfo{
+		DeviceType:  byte(fr.GetInt("deviceType")),
+		ExploitHwid: fr.GetString("exploitHwid"),
+	}
+
+	// NB: Devices are stored per session, so they hold what the subscription actually sent.
+	dr, err := app.FindFirstRecordByFilter("devices", "subscription = {:sbid}", dbx.Params{"sbid": sbr.Id})
+	fallback := err != nil
+
+	if fallback {
+		dr = ar
+	}
+
+	ir.KeyInfo.AnalyticsInfo = AnalyticsInfo{
+		SystemLocaleId:      dr.GetString("locale"),
+		OutputDevices:       dr.GetStringSlice("outputDevices"),
+		InputDevices:        dr.GetStringSlice("inputDevices"),
+		HasHyperion:         dr.GetBool("hasHyperion"),
+		HasTouchscreen:      dr.GetBool("hasTouchscreen"),
+		HasGyroscope:        dr.GetBool("hasGyroscope"),
+		GpuMemory:           int64(dr.GetInt("gpuMemory")),
+		Timezone:            dr.GetString("timezone"),
+		Region:              dr.GetString("region"),
+		DaylightSavingsTime: dr.GetBool("dst"),
+	}
+
+	var ws []string
+	if err := json.Unmarshal([]byte(sr.GetString("workspaceScan")), &ws); err != nil {
+		ws = []string{}
+	}
+
+	ir.SubInfo.SessionInfo = SessionInfo{
+		PlaySessionId:   sr.GetString("playSessionId"),
+		RobloxSessionId: sr.GetString("robloxSessionId"),
+		RobloxClientId:  sr.GetString("robloxClientId"),
+		WorkspaceScan:   ws,
+		LogHistory:      sr.GetStringSlice("logHistory"),
+	}
+
+	ji := JoinInfo{
+		UserName:   jr.GetString("userName"),
+		UserId:     jr.GetInt("userId"),
+		AccountAge: jr.GetInt("accountAge"),
+		PlaceId:    jr.GetInt("placeId"),
+	}
+
+	// NB: Joins stored before packing was introduced simply replay without relationships.
+	ji.UserGroups, _ = universe.Unpack(jr.GetString("groups"))
+	ji.UserFollowing, _ = universe.Unpack(jr.GetString("following"))
+	ji.UserFriends, _ = universe.Unpack(jr.GetString("friends"))
+
+	ir.SubInfo.JoinInfo = ji
+
+	return &ir, ar, fr, sr, fallback, nil
+}
+
+// Replay stored subscriptions through the current rules and list keys that would be newly flagged.
+func backtest(app *pocketbase.PocketBase, intel *ipintel.Database, opts BacktestOptions) (*BacktestReport, error) {
+	since, err := types.ParseDateTime(opts.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	sbl, err := app.FindRecordsByFilter(
+		"subscriptions",
+		"created >= {:since}",
+		"created", opts.Limit, 0, dbx.Params{"since": since},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*BacktestResult{}
+	index := map[string]*BacktestResult{}
+	fallbacks := 0
+	missing := 0
+	keys := map[string]*Key{}
+	projects := map[string]*Project{}
+
+	for _, sbr := range sbl {
+		kid := sbr.GetString("key")
+
+		kr, ok := keys[kid]
+		if !ok {
+			kr, err = FindKeyById(app, kid)
+			if err != nil {
+				continue
+			}
+
+			keys[kid] = kr
+		}
+
+		// NB: Keys that are already flagged are not news.
+		if kr.Blacklisted() || kr.GetBool("bolo") {
+			continue
+		}
+
+		pr, ok := projects[kid]
+		if !ok {
+			pr, err = kr.Project(app)
+			if err != nil {
+				continue
+			}
+
+			projects[kid] = pr
+		}
+
+		ir, ar, fr, sr, fallback, err := replayRequest(app, kr, sbr)
+		if err != nil {
+			missing += 1
+			continue
+		}
+
+		if fallback {
+			fallbacks += 1
+		}
+
+		ip := fr.GetString("ipAddress")
+
+		fi := ir.KeyInfo.FingerprintInfo
+		ai := ir.KeyInfo.AnalyticsInfo
+		si := ir.SubInfo.SessionInfo
+		ji := ir.SubInfo.JoinInfo
+
+		dv := newDevice(&ai)
+		ts := sbr.GetDateTime("created").Time()
+
+		// NB: Network, geo and travel are replayed from what the subscription was looked up as, not from the first address of the key.
+		ni := ipintel.Info{
+			ASN:        uint32(sbr.GetInt("asn")),
+			Country:    sbr.GetString("country"),
+			VPN:        sbr.GetBool("vpn"),
+			Datacenter: sbr.GetBool("datacenter"),
+			Located:    sbr.GetBool("located"),
+			Latitude:   sbr.GetFloat("latitude"),
+			Longitude:  sbr.GetFloat("longitude"),
+			TimeZone:   sbr.GetString("timezone"),
+		}
+
+		// Subscriptions from before the lookup was stored fall back to the current intelligence on the key's address.
+		if ni.ASN == 0 && len(ni.Country) <= 0 && !ni.Located {
+			ni = intel.Lookup(ip)
+		}
+
+		jd := newJudge(app, &bootstrapper{kr: kr, pr: pr}, sbr.Id)
+		jd.judge(RULE_BLACKLIST, checkBlacklist(app, ip, &fi, &si))
+
+		// NB: The first analytics of a key don't hold a device to compare.
+		if !fallback {
+			jd.judge(RULE_DEVICE, checkDevice(app, kr, &dv))
+		}
+
+		jd.judge(RULE_MISMATCH, checkMismatch(&fi, fr, ar, &ai, fr.GetString("exploitName")))
+		jd.judge(RULE_ASSOSIATION, checkAssosiation(&ji)...)
+		jd.judge(RULE_NETWORK, checkNetwork(&ni)...)
+		jd.judge(RULE_GEO, checkGeo(&ai, &ni, ts)...)
+		jd.judge(RULE_TRAVEL, checkTravel(app, kr, sbr.GetString("sid"), &ni, ts))
+
+		reasons := []string{}
+		for _, vd := range jd.verdicts {
+			reasons = append(reasons, fmt.Sprintf("%s: %s (%s, %s)", vd.Rule, vd.Reason, vd.Mode, vd.Action))
+		}
+
+		threshold := opts.WorkspaceThreshold
+		if threshold <= 0 {
+			threshold = pr.WorkspaceThreshold()
+		}
+
+		if state, _ := checkBolo(app, ip, sr.GetFloat("cpuStart"), &si, &ji, threshold); state != 0x0 {
+			reasons = append(reasons, fmt.Sprintf("bolo: matched bolo key (%s)", strings.Join(boloFlags(state), ", ")))
+		}
+
+		if len(reasons) <= 0 {
+			continue
+		}
+
+		br, ok := index[kid]
+		if !ok {
+			br = &BacktestResult{KeyId: kid, Reasons: []string{}}
+			index[kid] = br
+			results = append(results, br)
+		}
+
+		br.Subscriptions += 1
+
+		for _, reason := range reasons {
+			if !slices.Contains(br.Reasons, reason) {
+				br.Reasons = append(br.Reasons, reason)
+			}
+		}
+	}
+
+	skipped := slices.Clone(backtestSkipped)
+
+	if fallbacks > 0 {
+		skipped = append(skipped, fmt.Sprintf("device: %d subscriptions have no device record, their other rules were replayed from the first analytics of their key", fallbacks))
+	}
+
+	if missing > 0 {
+		skipped = append(skipped, fmt.Sprintf("all: %d subscriptions have no fingerprint, analytics, session or join record", missing))
+	}
+
+	return &BacktestReport{Results: results, Skipped: skipped}, nil
+}
+
+// Register the backtest endpoint for superusers.
+func bindBacktest(app *pocketbase.PocketBase, sv *server, se *core.ServeEvent) {
+	se.Router.GET("/rules/backtest", func(e *core.RequestEvent) error {
+		query := e.Request.URL.Query()
+		opts := BacktestOptions{Since: time.Now().Add(-7 * 24 * time.Hour)}
+
+		if value := query.Get("since"); len(value) > 0 {
+			dt, err := types.ParseDateTime(value)
+			if err != nil {
+				return apis.NewBadRequestError("invalid since date", err)
+			}
+
+			opts.Since = dt.Time()
+		}
+
+		if value := query.Get("workspaceThreshold"); len(value) > 0 {
+			wt, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return apis.NewBadRequestError("invalid workspace threshold", err)
+			}
+
+			opts.WorkspaceThreshold = wt
+		}
+
+		if value := query.Get("limit"); len(value) > 0 {
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				return apis.NewBadRequestError("invalid limit", err)
+			}
+
+			opts.Limit = limit
+		}
+
+		report, err := backtest(app, sv.intel, opts)
+		if err != nil {
+			return err
+		}
+
+		return e.JSON(http.StatusOK, report)
+	}).Bind(apis.RequireSuperuserAuth())
+}
+
+// Command that prints the backtest results.
+func backtestCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var since time.Duration
+	var opts BacktestOptions
+
+	cmd := &cobra.Command{
+		Use:   "backtest",
+		Short: "Replay stored identify data through the current detection rules",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			intel := ipintel.New(filepath.Join(app.DataDir(), "ipintel"))
+			if err := intel.Load(); err != nil {
+				cmd.PrintErrf("ip intelligence unavailable: %s\n", err)
+			}
+
+			opts.Since = time.Now().Add(-since)
+
+			report, err := backtest(app, intel, opts)
+			if err != nil {
+				return err
+			}
+
+			for _, br := range report.Results {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%d\t%s\n", br.KeyId, br.Subscriptions, strings.Join(br.Reasons, "; "))
+			}
+
+			for _, skipped := range report.Skipped {
+				fmt.Fprintf(cmd.OutOrStdout(), "not replayed: %s\n", skipped)
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%d keys would be newly flagged\n", len(report.Results))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationVar(&since, "since", 7*24*time.Hour, "replay subscriptions created within this duration")
+	cmd.Flags().Float64Var(&opts.WorkspaceThreshold, "workspace-threshold", 0, "override the workspace threshold of every project")
+	cmd.Flags().IntVar(&opts.Limit, "limit", 0, "maximum amount of subscriptions to replay")
+
+	return cmd
+}
@@ -1,19 +1,19 @@
 package main
 
 import (
-	"encoding/json"
+	"armorshield/notifier"
 	"errors"
-	"fmt"
 	"log/slog"
 	"time"
 
-	discordwebhook "github.com/bensch777/discord-webhook-golang"
+	"github.com/pocketbase/pocketbase/tools/types"
 	"github.com/shamaton/msgpack"
 )
 
 type bootstrapper struct {
 	kr *Key
 	pr *Project
+	pm Permissions
 	en string
 }
 
@@ -22,9 +22,28 @@ type Action uint32
 const (
 	ACTION_BLACKLIST Action = iota
 	ACTION_BOLO
+	ACTION_FREEZE
+	ACTION_MISMATCH
+	ACTION_CANARY
 )
 
-func (bs bootstrapper) alert(sub *subscription, action Action) error {
+func (ac Action) Severity() string {
+	switch ac {
+	case ACTION_BLACKLIST:
+		return SEVERITY_BLACKLIST
+	case ACTION_FREEZE:
+		return SEVERITY_FREEZE
+	case ACTION_MISMATCH:
+		return SEVERITY_MISMATCH
+	case ACTION_CANARY:
+		return SEVERITY_CANARY
+	}
+
+	return SEVERITY_BOLO
+}
+
+// Queue an alert for the subscription, it's delivered in the background.
+func (bs bootstrapper) alert(sub *subscription, action Action, reason string) error {
 	pr := bs.pr
 	if pr == nil {
 		return errors.New("project is not initialized")
@@ -40,39 +59,42 @@ func (bs bootstrapper) alert(sub *subscription, action Action) error {
 		return err
 	}
 
-	embed := discordwebhook.Embed{
-		Description: "Check Grafana Loki dashboard for more information.",
-		Timestamp:   time.Now(),
-		Footer: discordwebhook.Footer{
-			Text: fmt.Sprintf("Subscription ID: '%s'", sub.uuid.String()),
-		},
-		Author: discordwebhook.Author{
-			Name: fmt.Sprintf("PB Key ID & Discord ID (%s) (%s)", kr.Id, dd),
-		},
+	alert := notifier.Alert{
+		Severity:       action.Severity(),
+		Reason:         reason,
+		Mention:        true,
+		KeyId:          kr.Id,
+		DiscordId:      dd,
+		SubscriptionId: sub.uuid.String(),
+		Timestamp:      time.Now(),
 	}
 
 	if action == ACTION_BLACKLIST {
-		embed.Title = "Automated 'Blacklist Key' Alert"
-		embed.Color = 0xFAFF00
+		alert.Title = "Automated 'Blacklist Key' Alert"
+		alert.Color = 0xFAFF00
 	}
 
 	if action == ACTION_BOLO {
-		embed.Title = "Automated 'Be On The Lookout' Alert"
-		embed.Color = 0xFF0000
+		alert.Title = "Automated 'Be On The Lookout' Alert"
+		alert.Color = 0xFF0000
 	}
 
-	hook := discordwebhook.Hook{
-		Content:  "@everyone",
-		Username: "ArmorShield",
-		Embeds:   []discordwebhook.Embed{embed},
+	if action == ACTION_FREEZE {
+		alert.Title = "Automated 'Client Freeze' Alert"
+		alert.Color = 0x00A2FF
 	}
 
-	payload, err := json.Marshal(hook)
-	if err != nil {
-		return err
+	if action == ACTION_MISMATCH {
+		alert.Title = "Automated 'Mismatch' Alert"
+		alert.Color = 0xFF8800
+	}
+
+	if action == ACTION_CANARY {
+		alert.Title = "Automated 'Canary Key' Alert"
+		alert.Color = 0x9B00FF
 	}
 
-	return discordwebhook.ExecuteWebhook(pr.GetString("alertWebhook"), payload)
+	return notify(sub.app, pr, &alert)
 }
 
 // NB: This function will close the connection.
@@ -89,9 +111,74 @@ func (bs bootstrapper) blacklist(sub *subscription, reason string) error {
 		return err
 	}
 
-	bs.alert(sub, ACTION_BLACKLIST)
+	if err := bs.alert(sub, ACTION_BLACKLIST, reason); err != nil {
+		sub.logger.Error("failed to queue alert", slog.String("error", err.Error()))
+	}
 
-	return sub.close("you have been blacklisted")
+	return bs.reject(sub, reason, "you have been blacklisted")
+}
+
+// NB: This function might close the connection.
+func (bs bootstrapper) escalate(sub *subscription, action string, duration time.Duration, reason string) error {
+	kr := bs.kr
+	if kr == nil {
+		return errors.New("key is not initialized")
+	}
+
+	sub.logger.Warn("escalating subscription", slog.String("action", action), slog.String("reason", reason))
+
+	// NB: Canaries are only ever recorded, never acted on.
+	if kr.Canary() {
+		return nil
+	}
+
+	switch action {
+	case ESCALATE_BOLO:
+		if kr.GetBool("bolo") {
+			return nil
+		}
+
+		kr.Set("bolo", true)
+
+		if err := sub.app.Save(kr); err != nil {
+			return err
+		}
+
+		if err := bs.alert(sub, ACTION_BOLO, reason); err != nil {
+			sub.logger.Error("failed to queue alert", slog.String("error", err.Error()))
+		}
+
+		return nil
+	case ESCALATE_DROP:
+		return bs.reject(sub, reason, reason)
+	case ESCALATE_BAN:
+		until, err := types.ParseDateTime(time.Now().Add(duration))
+		if err != nil {
+			return err
+		}
+
+		kr.Set("bannedUntil", until)
+
+		if err := sub.app.Save(kr); err != nil {
+			return err
+		}
+
+		return bs.reject(sub, reason, "you have been temporarily banned")
+	}
+
+	return nil
+}
+
+// Check if a limit of the key's role is enforced on the subscription.
+// NB: Canaries are let through silently, the limits they hit are only logged.
+func enforced(sub *subscription, kr *Key, reason string) bool {
+	if !kr.Canary() {
+		return true
+	}
+
+	sub.logger.Warn("letting canary through", slog.String("reason", reason))
+
+	return false
 }
 
 func (bs bootstrapper) handle(sub *subscription, pk Packet) error {
@@ -124,14 +211,24 @@ func (bs bootstrapper) handle(sub *subscription, pk Packet) error {
 		return sub.close("key blacklisted")
 	}
 
+	if kr.Banned(sub.timestamp) {
+		return sub.close("key temporarily banned")
+	}
+
+	pm := resolveRole(sub.app, kr, pr)
+	if pm.Sessions > 0 && sub.server.count(kr) >= pm.Sessions && enforced(sub, kr, "too many sessions for your role") {
+		return sub.close("too many sessions for your role")
+	}
+
 	bs.kr = kr
 	bs.pr = pr
+	bs.pm = pm
 	bs.en = br.ExploitName
 
 	sub.logger = sub.logger.With(slog.String("discordId", di)).With(slog.String("keyId", kr.Id))
 	sub.state.AddFlag(STATE_BOOTSTRAPPED)
-	sub.handler = handshaker{hmac: [32]byte{}, rc4: [16]byte{}, bs: bs}
-	sub.bootstrapper = &bs
+	sub.handler = handshaker{hmac: [32]byte{}, rc4: [16]byte{}}
+	sub.server.bootstrap(sub, &bs)
 
 	return sub.message(Message{Id: PacketIdBootstrap, Data: BootResponse{
 		BaseTimestamp: uint64(sub.timestamp.Unix()),
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"armorshield/ipintel"
 	"armorshield/universe"
+	"strconv"
 	"strings"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
 )
 
 type ResultType uint32
@@ -27,8 +32,44 @@ const (
 	RESULT_LOCALE_MISMATCH
 	RESULT_REGION_MISMATCH
 	RESULT_DST_MISMATCH
+	RESULT_VPN_NETWORK
+	RESULT_DATACENTER_NETWORK
+	RESULT_GEO_REGION_MISMATCH
+	RESULT_GEO_TIMEZONE_MISMATCH
+	RESULT_GEO_DST_MISMATCH
+	RESULT_IMPOSSIBLE_TRAVEL
+	RESULT_DEVICE_MATCH
+	RESULT_FUNCTION_MISMATCH
+	RESULT_LUA_VERSION_MISMATCH
 )
 
+// Fastest plausible travel speed between two sessions in km/h.
+const MAX_TRAVEL_SPEED float64 = 1000.0
+
+// Distance in km under which travel is never considered impossible.
+const MIN_TRAVEL_DISTANCE float64 = 500.0
+
+// Fingerprints of blacklisted keys sharing an ip address before the address itself is considered blacklisted.
+const BLACKLIST_IP_THRESHOLD int = 3
+
+// check if the client runs on the luau version every supported exploit uses.
+func checkVersion(vi *VersionInfo) ResultType {
+	if vi.LuaVersion != "Luau" {
+		return RESULT_LUA_VERSION_MISMATCH
+	}
+
+	return RESULT_SUCCESS
+}
+
+// check if every probed function returned what was expected of it.
+func checkIntegrity(mismatches []string) ResultType {
+	if len(mismatches) > 0 {
+		return RESULT_FUNCTION_MISMATCH
+	}
+
+	return RESULT_SUCCESS
+}
+
 func checkAssosiation(ji *JoinInfo) []ResultType {
 	results := []ResultType{}
 
@@ -79,9 +120,152 @@ func checkAssosiation(ji *JoinInfo) []ResultType {
 	return results
 }
 
+func checkNetwork(info *ipintel.Info) []ResultType {
+	results := []ResultType{}
+
+	if info.VPN {
+		results = append(results, RESULT_VPN_NETWORK)
+	}
+
+	if info.Datacenter {
+		results = append(results, RESULT_DATACENTER_NETWORK)
+	}
+
+	return results
+}
+
+// The client reports it's timezone as "UTC+05" or "UTC-07".
+func parseTimezoneOffset(tz string) (int, bool) {
+	off, err := strconv.Atoi(strings.TrimPrefix(tz, "UTC"))
+	if err != nil {
+		return 0, false
+	}
+
+	return off, true
+}
+
+// check if the claimed region and timezone are plausible for the geolocation of the ip.
+func checkGeo(ai *AnalyticsInfo, ni *ipintel.Info, ts time.Time) []ResultType {
+	results := []ResultType{}
+
+	if len(ni.Country) > 0 && len(ai.Region) > 0 && !strings.EqualFold(ni.Country, ai.Region) {
+		results = append(results, RESULT_GEO_REGION_MISMATCH)
+	}
+
+	if !ni.Located {
+		return results
+	}
+
+	loc, err := time.LoadLocation(ni.TimeZone)
+	if err != nil {
+		return results
+	}
+
+	lt := ts.In(loc)
+
+	// NB: Allow an hour of slack for half-hour zones and DST transitions.
+	if off, ok := parseTimezoneOffset(ai.Timezone); ok {
+		_, secs := lt.Zone()
+		if diff := off*3600 - secs; diff > 3600 || diff < -3600 {
+			results = append(results, RESULT_GEO_TIMEZONE_MISMATCH)
+		}
+	}
+
+	if lt.IsDST() != ai.DaylightSavingsTime {
+		results = append(results, RESULT_GEO_DST_MISMATCH)
+	}
+
+	return results
+}
+
+// check if the key could have physically moved from it's last located session to this one.
+func checkTravel(app *pocketbase.PocketBase, kr *Key, sid string, ni *ipintel.Info, ts time.Time) ResultType {
+	if !ni.Located {
+		return RESULT_SUCCESS
+	}
+
+	lsr, err := app.FindRecordsByFilter(
+		"subscriptions",
+		"key = {:keyId} && sid != {:sid} && located = true && created < {:before}",
+		"-created", 1, 0, dbx.Params{"keyId": kr.Id, "sid": sid, "before": ts.UTC().Format(types.DefaultDateLayout)},
+	)
+
+	if err != nil || len(lsr) <= 0 {
+		return RESULT_SUCCESS
+	}
+
+	last := lsr[0]
+
+	km := ipintel.Distance(last.GetFloat("latitude"), last.GetFloat("longitude"), ni.Latitude, ni.Longitude)
+	if km <= MIN_TRAVEL_DISTANCE {
+		return RESULT_SUCCESS
+	}
+
+	hours := ts.Sub(last.GetDateTime("created").Time()).Hours()
+	if hours > 0 && km/hours <= MAX_TRAVEL_SPEED {
+		return RESULT_SUCCESS
+	}
+
+	return RESULT_IMPOSSIBLE_TRAVEL
+}
+
+// check if the session or join matches records of keys marked as bolo.
+func checkBolo(app *pocketbase.PocketBase, ip string, cpuStart float64, si *SessionInfo, ji *JoinInfo, threshold float64) (Bitmask, IncidentMatches) {
+	var state Bitmask
+	var matches IncidentMatches
+
+	bfr, err := app.FindFirstRecordByFilter(
+		"fingerprints",
+		"key.bolo != false && (ipAddress = {:ipAddress})",
+		dbx.Params{"ipAddress": ip},
+	)
+
+	if bfr != nil && err == nil {
+		state.AddFlag(BOLO_SESSION)
+		matches.Fingerprint = bfr
+	}
+
+	bsr, err := app.FindFirstRecordByFilter(
+		"sessions",
+		"subscription.key.bolo == true && (cpuStart = {:cpuStart} || playSessionId = {:playSessionId} || robloxSessionId = {:robloxSessionId})",
+		dbx.Params{"robloxSessionId": si.RobloxSessionId, "playSessionId": si.PlaySessionId, "cpuStart": cpuStart},
+	)
+
+	if bsr != nil && err == nil {
+		state.AddFlag(BOLO_SESSION)
+		matches.Session = bsr
+	}
+
+	bjr, err := app.FindFirstRecordByFilter(
+		"joins",
+		"subscription.key.bolo == true && userId = {:userId}",
+		dbx.Params{"userId": ji.UserId},
+	)
+
+	if bjr != nil && err == nil {
+		state.AddFlag(BOLO_JOIN)
+		matches.Join = bjr
+	}
+
+	bsrl, err := app.FindRecordsByFilter(
+		"sessions",
+		"subscription.key.bolo == true",
+		"", 0, 0, dbx.Params{},
+	)
+
+	if err == nil {
+		if bwr := partialMatchSessions(si.WorkspaceScan, bsrl, threshold); bwr != nil {
+			state.AddFlag(BOLO_WORKSPACE)
+			matches.Workspace = bwr
+		}
+	}
+
+	return state, matches
+}
+
 func checkBlacklist(app *pocketbase.PocketBase, ip string, fi *FingerprintInfo, si *SessionInfo) ResultType {
 	blfr, err := app.FindFirstRecordByFilter(
-		"fingerprint",
+		"fingerprints",
 		"key.blacklist != null && (exploitHwid = {:exploitHwid})",
 		dbx.Params{"exploitHwid": fi.ExploitHwid},
 	)
@@ -91,12 +275,12 @@ func checkBlacklist(app *pocketbase.PocketBase, ip string, fi *FingerprintInfo,
 	}
 
 	blips, err := app.FindRecordsByFilter(
-		"fingerprint",
+		"fingerprints",
 		"key.blacklist != null && (ipAddress = {:ipAddress})",
-		"", 2, 0, dbx.Params{"ipAddress": ip},
+		"", BLACKLIST_IP_THRESHOLD, 0, dbx.Params{"ipAddress": ip},
 	)
 
-	if len(blips) >= 3 && err == nil {
+	if len(blips) >= BLACKLIST_IP_THRESHOLD && err == nil {
 		return RESULT_IP_MATCH
 	}
 
@@ -107,6 +291,29 @@ func checkBlacklist(app *pocketbase.PocketBase, ip string, fi *FingerprintInfo,
 	return RESULT_SUCCESS
 }
 
+// check if the device closely matches a device of a blacklisted key, even if the exploit hwid was spoofed.
+func checkDevice(app *pocketbase.PocketBase, kr *Key, dv *Device) ResultType {
+	bldrl, err := app.FindRecordsByFilter(
+		"devices",
+		"key.blacklist != null && key != {:keyId} && gpuMemory = {:gpuMemory}",
+		"-created", 500, 0, dbx.Params{"keyId": kr.Id, "gpuMemory": dv.GpuMemory},
+	)
+
+	if err != nil {
+		return RESULT_SUCCESS
+	}
+
+	for _, bldr := range bldrl {
+		if similarity(*dv, deviceFromRecord(bldr)) < DEVICE_MATCH_THRESHOLD {
+			continue
+		}
+
+		return RESULT_DEVICE_MATCH
+	}
+
+	return RESULT_SUCCESS
+}
+
 // check for changed device or exploit, new region or locale or dst change. then check for hwid change.
 func checkMismatch(fi *FingerprintInfo, fr *core.Record, ar *core.Record, ai *AnalyticsInfo, en string) ResultType {
 	if fr.GetString("exploitHwid") != fi.ExploitHwid {
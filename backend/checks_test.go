@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Keys and their fingerprints, one of the keys blacklisted.
+func testFingerprints(t *testing.T) (*pocketbase.PocketBase, *core.Record) {
+	t.Helper()
+
+	app := newTestApp(t)
+
+	testCollection(t, app, "keys", &core.TextField{Name: "blacklist"})
+	testCollection(t, app, "fingerprints",
+		testRelation(t, app, "key", "keys"),
+		&core.TextField{Name: "exploitHwid"},
+		&core.TextField{Name: "ipAddress"},
+	)
+
+	blk := testRecord(t, app, "keys", map[string]any{"blacklist": "leaked"})
+	testRecord(t, app, "fingerprints", map[string]any{"key": blk.Id, "exploitHwid": "hwid-blacklisted", "ipAddress": "10.0.0.1"})
+
+	kr := testRecord(t, app, "keys", map[string]any{})
+	testRecord(t, app, "fingerprints", map[string]any{"key": kr.Id, "exploitHwid": "hwid-clean", "ipAddress": "10.0.0.2"})
+
+	return app, blk
+}
+
+func TestBlacklistHwid(t *testing.T) {
+	app, _ := testFingerprints(t)
+
+	if rt := checkBlacklist(app, "10.0.0.9", &FingerprintInfo{ExploitHwid: "hwid-blacklisted"}, &SessionInfo{}); rt != RESULT_FINGERPRINT_MATCH {
+		t.Fatalf("blacklisted hwid returned %d", rt)
+	}
+
+	if rt := checkBlacklist(app, "10.0.0.9", &FingerprintInfo{ExploitHwid: "hwid-clean"}, &SessionInfo{}); rt != RESULT_SUCCESS {
+		t.Fatalf("clean hwid returned %d", rt)
+	}
+}
+
+func TestBlacklistIp(t *testing.T) {
+	app, blk := testFingerprints(t)
+	fi := &FingerprintInfo{ExploitHwid: "hwid-new"}
+
+	for idx := 1; idx < BLACKLIST_IP_THRESHOLD; idx++ {
+		testRecord(t, app, "fingerprints", map[string]any{"key": blk.Id, "exploitHwid": "hwid-other", "ipAddress": "10.0.0.3"})
+	}
+
+	if rt := checkBlacklist(app, "10.0.0.3", fi, &SessionInfo{}); rt != RESULT_SUCCESS {
+		t.Fatalf("ip below the threshold returned %d", rt)
+	}
+
+	testRecord(t, app, "fingerprints", map[string]any{"key": blk.Id, "exploitHwid": "hwid-other", "ipAddress": "10.0.0.3"})
+
+	if rt := checkBlacklist(app, "10.0.0.3", fi, &SessionInfo{}); rt != RESULT_IP_MATCH {
+		t.Fatalf("ip at the threshold returned %d", rt)
+	}
+}
@@ -33,6 +33,9 @@ const (
 	PacketIdDropping
 	PacketIdKeyUpdate
 	PacketIdFreeze
+	PacketIdFunctionCheck
+	PacketIdAttest
+	PacketIdChunk
 )
 
 type BootRequest struct {
@@ -115,15 +118,44 @@ type IdentifyRequest struct {
 }
 
 type IdentifyResponse struct {
-	CurrentRole string
+	CurrentRole     string
+	FreezeThreshold float64
+	Permissions     Permissions
 }
 
 type LoadRequest struct {
-	GameId uint64
+	GameId  uint64
+	PlaceId uint64
+}
+
+type LoadModule struct {
+	ScriptId  string
+	VersionId string
+	Streamed  bool
+	Size      uint64
+	Chunks    uint32
+	Digest    [32]byte
 }
 
 type LoadResponse struct {
+	ScriptId   string
+	VersionId  string
+	Modules    []LoadModule
+	UnsealKeys map[string][16]byte
+}
+
+type ChunkRequest struct {
 	ScriptId string
+	Index    uint32
+	Count    uint32
+}
+
+type ChunkPacket struct {
+	ScriptId string
+	Index    uint32
+	Total    uint32
+	Data     string
+	Digest   [32]byte
 }
 
 type DropPacket struct {
@@ -131,9 +163,49 @@ type DropPacket struct {
 }
 
 type KeyUpdatePacket struct {
-	Role string
+	Role        string
+	Permissions Permissions
 }
 
 type FreezePacket struct {
 	Seconds float64
 }
+
+type FunctionProbe struct {
+	Id       string
+	Function string
+	Kind     byte
+}
+
+type FunctionCheckRequest struct {
+	Probes []FunctionProbe
+}
+
+type FunctionCheckData struct {
+	String      string
+	StringArray []string
+	Boolean     bool
+	GetInfo     map[string]interface{}
+	Info        map[string]interface{}
+	Byte        byte
+}
+
+type FunctionCheckResult struct {
+	Id   string
+	Data FunctionCheckData
+}
+
+type FunctionCheckResponse struct {
+	Results []FunctionCheckResult
+}
+
+type AttestRequest struct {
+	Nonce    [16]byte
+	Fields   uint32
+	Deadline uint64
+}
+
+type AttestResponse struct {
+	Nonce [16]byte
+	Mac   [32]byte
+}
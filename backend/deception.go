@@ -0,0 +1,223 @@
+package main
+
+import (
+	"log/slog"
+	mrand "math/rand/v2"
+	"time"
+
+	"github.com/pocketbase/dbx"
+)
+
+// Message shown instead of the real drop reason if the project doesn't specify one.
+const DEFAULT_DECEPTION_MESSAGE = "an unexpected error occurred, please try again later"
+
+// How a project misleads flagged subscriptions.
+type DeceptionPolicy struct {
+	// Hide the drop reason behind a generic message.
+	Generic bool
+
+	// The generic message.
+	Message string
+
+	// Range of the random delay before dropping.
+	// NB: Zero drops immediately.
+	DelayMin time.Duration
+	DelayMax time.Duration
+
+	// Serve the decoy script instead of dropping before the script is loaded.
+	Decoy bool
+
+	// Time every response to a flagged subscription is held back for.
+	Slow time.Duration
+}
+
+func (pr *Project) DeceptionPolicy() DeceptionPolicy {
+	dp := DeceptionPolicy{
+		Generic:  pr.GetBool("deceptionGeneric"),
+		Message:  pr.GetString("deceptionMessage"),
+		DelayMin: time.Duration(pr.GetFloat("deceptionDelayMin") * float64(time.Second)),
+		DelayMax: time.Duration(pr.GetFloat("deceptionDelayMax") * float64(time.Second)),
+		Decoy:    pr.GetBool("deceptionDecoy"),
+		Slow:     time.Duration(pr.GetFloat("deceptionSlow") * float64(time.Second)),
+	}
+
+	if len(dp.Message) <= 0 {
+		dp.Message = DEFAULT_DECEPTION_MESSAGE
+	}
+
+	if dp.DelayMax < dp.DelayMin {
+		dp.DelayMax = dp.DelayMin
+	}
+
+	return dp
+}
+
+// A random delay within the range of the policy.
+func (dp DeceptionPolicy) delay() time.Duration {
+	if dp.DelayMax <= 0 {
+		return 0
+	}
+
+	return dp.DelayMin + time.Duration(mrand.Int64N(int64(dp.DelayMax-dp.DelayMin)+1))
+}
+
+// Hold back for the slow-walk time of the policy.
+// NB: Returns false if the subscription ended in the meantime.
+func (dp DeceptionPolicy) stall(sub *subscription) bool {
+	if dp.Slow <= 0 || sub.ctx == nil {
+		return true
+	}
+
+	select {
+	case <-time.After(dp.Slow):
+		return true
+	case <-sub.ctx.Done():
+		return false
+	}
+}
+
+// Keep the real reason of a drop in our own records.
+func recordDrop(sub *subscription, reason string) {
+	sub.logger.Warn("rejecting subscription", slog.String("reason", reason))
+
+	sbr, err := sub.app.FindFirstRecordByFilter("subscriptions", "sid = {:sid}", dbx.Params{"sid": sub.uuid.String()})
+	if err != nil {
+		return
+	}
+
+	sbr.Set("dropReason", reason)
+
+	if err := sub.app.Save(sbr); err != nil {
+		sub.logger.Error("failed to record drop reason", slog.String("error", err.Error()))
+	}
+}
+
+// Plays along with a flagged subscription until it's dropped.
+type deceiver struct {
+	policy  DeceptionPolicy
+	message string
+	decoy   bool
+	next    byte
+}
+
+func (dc *deceiver) handle(sub *subscription, pk Packet) error {
+	hs := sub.handshaker
+	bs := sub.bootstrapper
+
+	if !dc.policy.stall(sub) {
+		return nil
+	}
+
+	switch pk.Id {
+	case PacketIdFunctionCheck:
+		dc.next = PacketIdLoad
+	case PacketIdLoad:
+		dc.next = 0
+
+		if !dc.decoy {
+			return nil
+		}
+
+		sr, err := decoyScript(sub, bs.kr, bs.pr)
+		if err != nil {
+			return sub.close(dc.message)
+		}
+
+		// NB: The decoy is served whatever it's modules are checked against.
+		modules, _ := scriptModules(sub.app, bs.pr, bs.kr, &bs.pm, sr, sr.GetString("version"))
+		resp := loadResponse(sub, *hs, sr, sr.GetString("version"), modules, false)
+
+		sub.script = sr.Id
+		sub.state.AddFlag(STATE_LOADED)
+
+		return hs.message(sub, Message{Id: PacketIdLoad, Data: resp})
+	}
+
+	return nil
+}
+
+func (dc *deceiver) packet() byte {
+	return dc.next
+}
+
+func (dc *deceiver) state(sub *subscription) bool {
+	return dc.next != 0
+}
+
+// Drop a flagged subscription according to the deception policy of it's project.
+// NB: This function might close the connection, now or later.
+func (bs bootstrapper) reject(sub *subscription, reason string, message string) error {
+	recordDrop(sub, reason)
+
+	if bs.pr == nil {
+		return sub.close(message)
+	}
+
+	dp := bs.pr.DeceptionPolicy()
+	if dp.Generic {
+		message = dp.Message
+	}
+
+	dc := &deceiver{policy: dp, message: message}
+	delay := dp.delay()
+
+	// NB: Only play along with a decoy if the script wasn't loaded yet and there is a decoy to serve.
+	if _, err := decoyScript(sub, bs.kr, bs.pr); err == nil && dp.Decoy && sub.handshaker != nil {
+		dc.decoy = !sub.state.HasFlag(STATE_LOADED)
+	}
+
+	if delay <= 0 && !dc.decoy {
+		dp.stall(sub)
+		return sub.close(message)
+	}
+
+	switch {
+	case sub.state.HasFlag(STATE_LOADED):
+		dc.next = 0
+	case sub.state.HasFlag(STATE_IDENTIFIED):
+		dc.next = PacketIdLoad
+	case dc.decoy:
+		if err := bs.pretend(sub, dc); err != nil {
+			return err
+		}
+	}
+
+	// NB: Anything the subscription sends that isn't expected ends it early.
+	sub.handler = dc
+
+	if delay > 0 {
+		go bs.dropLater(sub, delay, message)
+	}
+
+	return nil
+}
+
+// Pretend the subscription identified fine, and ask for no function checks.
+func (bs bootstrapper) pretend(sub *subscription, dc *deceiver) error {
+	hs := sub.handshaker
+
+	sub.state.AddFlag(STATE_IDENTIFIED)
+	dc.next = PacketIdFunctionCheck
+
+	err := hs.message(sub, Message{Id: PacketIdIdentify, Data: IdentifyResponse{
+		CurrentRole:     bs.kr.GetString("role"),
+		FreezeThreshold: bs.pr.FreezePolicy().Threshold,
+		Permissions:     bs.pm,
+	}})
+
+	if err != nil {
+		return err
+	}
+
+	return hs.message(sub, Message{Id: PacketIdFunctionCheck, Data: FunctionCheckRequest{
+		Probes: []FunctionProbe{},
+	}})
+}
+
+func (bs bootstrapper) dropLater(sub *subscription, delay time.Duration, message string) {
+	select {
+	case <-time.After(delay):
+		sub.dispatch(func() error { return sub.close(message) })
+	case <-sub.ctx.Done():
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"armorshield/record"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Similarity at which two devices are considered to be the same machine.
+const DEVICE_MATCH_THRESHOLD float64 = 0.85
+
+// The full analytics fingerprint of a machine.
+type Device struct {
+	Locale         string
+	Region         string
+	Timezone       string
+	Dst            bool
+	OutputDevices  []string
+	InputDevices   []string
+	GpuMemory      int64
+	HasHyperion    bool
+	HasTouchscreen bool
+	HasGyroscope   bool
+}
+
+func newDevice(ai *AnalyticsInfo) Device {
+	return Device{
+		Locale:         ai.SystemLocaleId,
+		Region:         ai.Region,
+		Timezone:       ai.Timezone,
+		Dst:            ai.DaylightSavingsTime,
+		OutputDevices:  ai.OutputDevices,
+		InputDevices:   ai.InputDevices,
+		GpuMemory:      ai.GpuMemory,
+		HasHyperion:    ai.HasHyperion,
+		HasTouchscreen: ai.HasTouchscreen,
+		HasGyroscope:   ai.HasGyroscope,
+	}
+}
+
+func deviceFromRecord(dr *core.Record) Device {
+	return Device{
+		Locale:         dr.GetString("locale"),
+		Region:         dr.GetString("region"),
+		Timezone:       dr.GetString("timezone"),
+		Dst:            dr.GetBool("dst"),
+		OutputDevices:  dr.GetStringSlice("outputDevices"),
+		InputDevices:   dr.GetStringSlice("inputDevices"),
+		GpuMemory:      int64(dr.GetInt("gpuMemory")),
+		HasHyperion:    dr.GetBool("hasHyperion"),
+		HasTouchscreen: dr.GetBool("hasTouchscreen"),
+		HasGyroscope:   dr.GetBool("hasGyroscope"),
+	}
+}
+
+func sorted(ss []string) []string {
+	cs := slices.Clone(ss)
+	slices.Sort(cs)
+	return slices.Compact(cs)
+}
+
+// A stable hash of the device, used to tell if a machine changed between sessions.
+func (dv Device) digest() string {
+	h := sha256.New()
+
+	flags := []bool{dv.Dst, dv.HasHyperion, dv.HasTouchscreen, dv.HasGyroscope}
+	for _, flag := range flags {
+		if flag {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	}
+
+	gm := make([]byte, 8)
+	binary.LittleEndian.PutUint64(gm, uint64(dv.GpuMemory))
+	h.Write(gm)
+
+	for _, s := range []string{dv.Locale, dv.Region, dv.Timezone} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	h.Write([]byte(strings.Join(sorted(dv.OutputDevices), "\x00")))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(sorted(dv.InputDevices), "\x00")))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func jaccard(a []string, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1.0
+	}
+
+	set := make(map[string]bool)
+	for _, s := range a {
+		set[s] = true
+	}
+
+	inter := 0
+	union := len(set)
+
+	seen := make(map[string]bool)
+	for _, s := range b {
+		if seen[s] {
+			continue
+		}
+
+		seen[s] = true
+
+		if set[s] {
+			inter += 1
+		} else {
+			union += 1
+		}
+	}
+
+	return float64(inter) / float64(union)
+}
+
+func weight(match bool, w float64) float64 {
+	if !match {
+		return 0.0
+	}
+
+	return w
+}
+
+// Weighted similarity of two devices from 0.0 to 1.0.
+// NB: Audio devices and GPU memory carry the most weight since they rarely change and are not tied to the exploit.
+func similarity(a Device, b Device) float64 {
+	score := 0.0
+	score += 0.30 * jaccard(a.OutputDevices, b.OutputDevices)
+	score += 0.20 * jaccard(a.InputDevices, b.InputDevices)
+	score += weight(a.GpuMemory == b.GpuMemory, 0.20)
+	score += weight(a.Timezone == b.Timezone, 0.10)
+	score += weight(a.Locale == b.Locale, 0.05)
+	score += weight(a.HasHyperion == b.HasHyperion, 0.05)
+	score += weight(a.HasTouchscreen == b.HasTouchscreen, 0.05)
+	score += weight(a.HasGyroscope == b.HasGyroscope, 0.05)
+	return score
+}
+
+// Check if the device would take a new slot while every device slot of the key is taken.
+func devicesExceeded(app *pocketbase.PocketBase, kr *Key, dv *Device, slots int) bool {
+	drl, err := app.FindRecordsByFilter("devices", "key = {:keyId}", "", 0, 0, dbx.Params{"keyId": kr.Id})
+	if err != nil {
+		return false
+	}
+
+	digest := dv.digest()
+	digests := map[string]struct{}{}
+
+	for _, dr := range drl {
+		if dr.GetString("digest") == digest {
+			return false
+		}
+
+		digests[dr.GetString("digest")] = struct{}{}
+	}
+
+	return len(digests) >= slots
+}
+
+// Store the device for a session, bumping the version of the key's device if it changed.
+func recordDevice(app *pocketbase.PocketBase, kr *Key, sbid string, dv Device) (*core.Record, error) {
+	version := 1
+	digest := dv.digest()
+
+	ldr, err := app.FindRecordsByFilter("devices", "key = {:keyId}", "-created", 1, 0, dbx.Params{"keyId": kr.Id})
+	if err == nil && len(ldr) > 0 {
+		version = ldr[0].GetInt("version")
+
+		if ldr[0].GetString("digest") != digest {
+			version += 1
+		}
+	}
+
+	return record.Create(app, "devices", map[string]any{
+		"key":            kr.Id,
+		"subscription":   sbid,
+		"version":        version,
+		"digest":         digest,
+		"locale":         dv.Locale,
+		"region":         dv.Region,
+		"timezone":       dv.Timezone,
+		"dst":            dv.Dst,
+		"outputDevices":  dv.OutputDevices,
+		"inputDevices":   dv.InputDevices,
+		"gpuMemory":      dv.GpuMemory,
+		"hasHyperion":    dv.HasHyperion,
+		"hasTouchscreen": dv.HasTouchscreen,
+		"hasGyroscope":   dv.HasGyroscope,
+	})
+}
@@ -1,13 +1,45 @@
 package main
 
 import (
-	"golang.org/x/exp/slog"
+	"armorshield/record"
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/types"
 )
 
 type freezer struct {
 	hs handshaker
 }
 
+// Store the freeze and link it to the subscription if it was identified already.
+func (fz freezer) persist(sub *subscription, fp *FreezePacket) error {
+	data := map[string]any{
+		"key":     sub.bootstrapper.kr.Id,
+		"sid":     sub.uuid.String(),
+		"seconds": fp.Seconds,
+	}
+
+	sbr, err := sub.app.FindFirstRecordByFilter("subscriptions", "sid = {:sid}", dbx.Params{"sid": sub.uuid.String()})
+	if sbr != nil && err == nil {
+		data["subscription"] = sbr.Id
+	}
+
+	_, err = record.Create(sub.app, "freezes", data)
+	return err
+}
+
+// NB: This function might close the connection.
+func (fz freezer) escalate(sub *subscription, policy *FreezePolicy, reason string) error {
+	bs := sub.bootstrapper
+
+	if err := bs.alert(sub, ACTION_FREEZE, reason); err != nil {
+		sub.logger.Error("failed to queue alert", slog.String("error", err.Error()))
+	}
+
+	return bs.escalate(sub, policy.Action, policy.BanDuration, reason)
+}
+
 func (fz freezer) handle(sub *subscription, pk Packet) error {
 	var fp FreezePacket
 	err := fz.hs.unmarshal(sub, pk.Msg, &fp)
@@ -17,7 +49,42 @@ func (fz freezer) handle(sub *subscription, pk Packet) error {
 
 	sub.logger.Warn("client was frozen", slog.Float64("seconds", fp.Seconds))
 
-	return nil
+	if err := fz.persist(sub, &fp); err != nil {
+		return err
+	}
+
+	policy := sub.bootstrapper.pr.FreezePolicy()
+	if policy.Action == ESCALATE_NONE {
+		return nil
+	}
+
+	if policy.Seconds > 0 && fp.Seconds >= policy.Seconds {
+		return fz.escalate(sub, &policy, "client froze for too long")
+	}
+
+	if policy.Limit <= 0 {
+		return nil
+	}
+
+	// NB: Freezes are counted per key, so reconnecting doesn't reset the escalation.
+	since := types.NowDateTime().Add(-policy.Window)
+
+	count, err := sub.app.CountRecords(
+		"freezes",
+		dbx.HashExp{"key": sub.bootstrapper.kr.Id},
+		dbx.NewExp("created >= {:since}", dbx.Params{"since": since.String()}),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	// NB: Only escalate once when the limit is reached.
+	if count != int64(policy.Limit) {
+		return nil
+	}
+
+	return fz.escalate(sub, &policy, "client froze too often")
 }
 
 func (fz freezer) packet() byte {
@@ -3,16 +3,17 @@ module armorshield
 go 1.23.4
 
 require (
+	github.com/bensch777/discord-webhook-golang v0.0.6
+	github.com/ebitengine/purego v0.8.1
+	github.com/oschwald/maxminddb-golang v1.13.1
 	github.com/pocketbase/pocketbase v0.23.4
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	nhooyr.io/websocket v1.8.17
 )
 
 require (
 	cloud.google.com/go/iam v1.2.2 // indirect
-	github.com/bensch777/discord-webhook-golang v0.0.6 // indirect
-	github.com/ebitengine/purego v0.8.1 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20241113202542-65e8d215514f // indirect
-	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 )
 
 require (
@@ -55,12 +56,12 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d // indirect
 	github.com/ncruces/go-strftime v0.1.9 // indirect
-	github.com/pocketbase/dbx v1.10.1 // indirect
+	github.com/pocketbase/dbx v1.10.1
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/shamaton/msgpack v1.2.1
 	github.com/shamaton/msgpack/v2 v2.2.2
 	github.com/spf13/cast v1.7.0 // indirect
-	github.com/spf13/cobra v1.8.1 // indirect
+	github.com/spf13/cobra v1.8.1
 	github.com/spf13/pflag v1.0.5 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	gocloud.dev v0.40.0 // indirect
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"armorshield/universe"
+	"log/slog"
+
+	"github.com/pocketbase/pocketbase"
+)
+
+// A disjoint set over key ids.
+type clusters map[string]string
+
+func (cl clusters) find(id string) string {
+	parent, ok := cl[id]
+	if !ok {
+		cl[id] = id
+		return id
+	}
+
+	if parent == id {
+		return id
+	}
+
+	root := cl.find(parent)
+	cl[id] = root
+
+	return root
+}
+
+func (cl clusters) union(a string, b string) {
+	ra := cl.find(a)
+	rb := cl.find(b)
+
+	if ra == rb {
+		return
+	}
+
+	// NB: Keep the smallest id as the root so cluster ids are stable between runs.
+	if rb < ra {
+		ra, rb = rb, ra
+	}
+
+	cl[rb] = ra
+}
+
+// Union every key that shares the same value.
+func (cl clusters) link(shared map[string][]string) {
+	for value, keys := range shared {
+		if len(value) <= 0 {
+			continue
+		}
+
+		for _, kid := range keys[1:] {
+			cl.union(keys[0], kid)
+		}
+	}
+}
+
+// Cluster keys that share Roblox users, friends, HWIDs, IPs or session ids.
+func buildClusters(app *pocketbase.PocketBase) (clusters, error) {
+	cl := clusters{}
+
+	subs, err := app.FindAllRecords("subscriptions")
+	if err != nil {
+		return nil, err
+	}
+
+	// Subscription record id to key id.
+	sk := make(map[string]string, len(subs))
+	for _, sbr := range subs {
+		sk[sbr.Id] = sbr.GetString("key")
+	}
+
+	fingerprints, err := app.FindAllRecords("fingerprints")
+	if err != nil {
+		return nil, err
+	}
+
+	hwids := map[string][]string{}
+	ips := map[string][]string{}
+
+	for _, fr := range fingerprints {
+		kid := fr.GetString("key")
+		hwids[fr.GetString("exploitHwid")] = append(hwids[fr.GetString("exploitHwid")], kid)
+		ips[fr.GetString("ipAddress")] = append(ips[fr.GetString("ipAddress")], kid)
+	}
+
+	sessions, err := app.FindAllRecords("sessions")
+	if err != nil {
+		return nil, err
+	}
+
+	sids := map[string][]string{}
+
+	for _, sr := range sessions {
+		kid, ok := sk[sr.GetString("subscription")]
+		if !ok {
+			continue
+		}
+
+		sids[sr.GetString("robloxSessionId")] = append(sids[sr.GetString("robloxSessionId")], kid)
+		sids[sr.GetString("playSessionId")] = append(sids[sr.GetString("playSessionId")], kid)
+	}
+
+	joins, err := app.FindAllRecords("joins")
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[uint64][]string{}
+
+	for _, jr := range joins {
+		kid, ok := sk[jr.GetString("subscription")]
+		if !ok {
+			continue
+		}
+
+		uid := uint64(jr.GetInt("userId"))
+		users[uid] = append(users[uid], kid)
+	}
+
+	for _, keys := range users {
+		for _, kid := range keys[1:] {
+			cl.union(keys[0], kid)
+		}
+	}
+
+	for _, jr := range joins {
+		kid, ok := sk[jr.GetString("subscription")]
+		if !ok {
+			continue
+		}
+
+		friends, err := universe.Unpack(jr.GetString("friends"))
+		if err != nil {
+			continue
+		}
+
+		for _, fid := range friends {
+			for _, okid := range users[fid] {
+				cl.union(kid, okid)
+			}
+		}
+	}
+
+	cl.link(hwids)
+	cl.link(ips)
+	cl.link(sids)
+
+	return cl, nil
+}
+
+// Rebuild the key clusters and flag keys that attached to a cluster with a blacklisted key.
+func updateClusters(app *pocketbase.PocketBase) error {
+	cl, err := buildClusters(app)
+	if err != nil {
+		return err
+	}
+
+	krl, err := app.FindAllRecords("keys")
+	if err != nil {
+		return err
+	}
+
+	sizes := map[string]int{}
+	blacklisted := map[string]bool{}
+
+	for _, rec := range krl {
+		key := &Key{}
+		key.SetProxyRecord(rec)
+
+		root := cl.find(key.Id)
+		sizes[root] += 1
+
+		if key.Blacklisted() {
+			blacklisted[root] = true
+		}
+	}
+
+	for _, rec := range krl {
+		key := &Key{}
+		key.SetProxyRecord(rec)
+
+		root := cl.find(key.Id)
+		flagged := blacklisted[root] && !key.Blacklisted()
+
+		if key.GetString("cluster") == root && key.GetInt("clusterSize") == sizes[root] && key.GetBool("clusterFlagged") == flagged {
+			continue
+		}
+
+		if flagged && !key.GetBool("clusterFlagged") {
+			app.Logger().Warn("key attached to a cluster with a blacklisted key", slog.String("keyId", key.Id), slog.String("cluster", root))
+		}
+
+		key.Set("cluster", root)
+		key.Set("clusterSize", sizes[root])
+		key.Set("clusterFlagged", flagged)
+
+		if err := app.Save(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
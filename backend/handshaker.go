@@ -24,7 +24,6 @@ const (
 type handshaker struct {
 	hmac [32]byte
 	rc4  [16]byte
-	bs   bootstrapper
 }
 
 func (hs handshaker) mac(ba []byte, uuid *uuid.UUID, time *time.Time) []byte {
@@ -46,7 +45,7 @@ func (hs handshaker) marshal(sub *subscription, data interface{}) ([]byte, error
 		return nil, err
 	}
 
-	sub.logger.Info("handshake marshal", slog.Any("data", data))
+	sub.logger.Info("handshake marshal", slog.Any("data", redact(data)))
 
 	cr, err := rc4.NewCipher(hs.rc4[:])
 	if err != nil {
@@ -99,7 +98,7 @@ func (hs handshaker) handle(sub *subscription, pk Packet) error {
 		return err
 	}
 
-	pr := hs.bs.pr
+	pr := sub.bootstrapper.pr
 
 	st, err := pr.Salt()
 	if err != nil {
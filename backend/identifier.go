@@ -1,13 +1,14 @@
 package main
 
 import (
+	"armorshield/ipintel"
 	"armorshield/record"
+	"armorshield/universe"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"math"
 
-	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/core"
 )
 
@@ -16,7 +17,7 @@ type identifier struct {
 }
 
 const (
-	BOLO_SESSION Bitmask = iota
+	BOLO_SESSION Bitmask = 1 << iota
 	BOLO_JOIN
 	BOLO_WORKSPACE
 )
@@ -41,7 +42,8 @@ func matchPercentage(ws []string, ows []string) float64 {
 	return float64(hits) / float64(len(ws))
 }
 
-func partialMatchSessions(match []string, sessions []*core.Record) bool {
+// Find the first session with a workspace that partially matches.
+func partialMatchSessions(match []string, sessions []*core.Record, threshold float64) *core.Record {
 	for _, session := range sessions {
 		var ws []string
 		err := json.Unmarshal([]byte(session.GetString("workspaceScan")), &ws)
@@ -50,14 +52,14 @@ func partialMatchSessions(match []string, sessions []*core.Record) bool {
 		}
 
 		percentage := matchPercentage(match, ws)
-		if percentage <= 0.33 {
+		if percentage <= threshold {
 			continue
 		}
 
-		return true
+		return session
 	}
 
-	return false
+	return nil
 }
 
 func round(num float64) int {
@@ -69,18 +71,26 @@ func toFixed(num float64, precision int) float64 {
 	return float64(round(num*output)) / output
 }
 
-func (id *identifier) identifiers(sub *subscription, ir *IdentifyRequest, timestamp uint64) (*core.Record, *core.Record, *core.Record, *core.Record, error) {
+func (id *identifier) identifiers(sub *subscription, ir *IdentifyRequest, ni *ipintel.Info, timestamp uint64) (*core.Record, *core.Record, *core.Record, *core.Record, error) {
 	fi := ir.KeyInfo.FingerprintInfo
 	ai := ir.KeyInfo.AnalyticsInfo
 	si := ir.SubInfo.SessionInfo
 	ji := ir.SubInfo.JoinInfo
 
-	bs := id.hs.bs
+	bs := sub.bootstrapper
 	kr := bs.kr
 
 	sbr, err := record.Create(sub.app, "subscriptions", map[string]any{
-		"key": kr.Id,
-		"sid": sub.uuid.String(),
+		"key":        kr.Id,
+		"sid":        sub.uuid.String(),
+		"asn":        ni.ASN,
+		"country":    ni.Country,
+		"vpn":        ni.VPN,
+		"datacenter": ni.Datacenter,
+		"located":    ni.Located,
+		"latitude":   ni.Latitude,
+		"longitude":  ni.Longitude,
+		"timezone":   ni.TimeZone,
 	})
 
 	if err != nil {
@@ -98,11 +108,14 @@ func (id *identifier) identifiers(sub *subscription, ir *IdentifyRequest, timest
 		return nil, nil, nil, nil, err
 	}
 
+	// NB: The fingerprint keeps the network of the key's first identify, the subscription above has the one of every session.
 	fr, err := record.ExpectLinkedRecord(sub.app, kr.Record, "fingerprints", map[string]any{
 		"deviceType":  fi.DeviceType,
 		"exploitHwid": fi.ExploitHwid,
 		"exploitName": bs.en,
 		"ipAddress":   sub.ip,
+		"asn":         ni.ASN,
+		"country":     ni.Country,
 		"key":         kr.Id,
 	})
 
@@ -129,6 +142,9 @@ func (id *identifier) identifiers(sub *subscription, ir *IdentifyRequest, timest
 		"userName":     ji.UserName,
 		"accountAge":   ji.AccountAge,
 		"placeId":      ji.PlaceId,
+		"groups":       universe.Pack(ji.UserGroups),
+		"following":    universe.Pack(ji.UserFollowing),
+		"friends":      universe.Pack(ji.UserFriends),
 		"subscription": sbr.Id,
 	})
 
@@ -147,85 +163,92 @@ func (id identifier) handle(sub *subscription, pk Packet) error {
 	}
 
 	app := sub.app
-	bs := id.hs.bs
+	bs := sub.bootstrapper
 	fi := ir.KeyInfo.FingerprintInfo
 	ai := ir.KeyInfo.AnalyticsInfo
 	ji := ir.SubInfo.JoinInfo
 	si := ir.SubInfo.SessionInfo
 
-	ar, fr, _, _, err := id.identifiers(sub, &ir, pk.Timestamp)
+	ni := sub.intel.Lookup(sub.ip)
+
+	ar, fr, sr, jr, err := id.identifiers(sub, &ir, &ni, pk.Timestamp)
 	if err != nil {
 		return err
 	}
 
-	if ir.SubInfo.VersionInfo.LuaVersion != "Luau" {
-		return bs.blacklist(sub, "invalid lua version")
-	}
+	dv := newDevice(&ai)
 
-	if rt := checkBlacklist(app, sub.ip, &fi, &si); rt != RESULT_SUCCESS {
-		return bs.blacklist(sub, fmt.Sprintf("linked key with blacklist (%d)", rt))
+	if bs.pm.Devices > 0 && devicesExceeded(app, bs.kr, &dv, bs.pm.Devices) && enforced(sub, bs.kr, "too many devices for your role") {
+		return sub.close("too many devices for your role")
 	}
 
-	if rt := checkMismatch(&fi, fr, ar, &ai, bs.en); rt != RESULT_SUCCESS {
-		return sub.close(fmt.Sprintf("reset your HWID on the panel (%d)", rt))
+	_, err = recordDevice(app, bs.kr, sr.GetString("subscription"), dv)
+	if err != nil {
+		return err
 	}
 
-	if rt := checkAssosiation(&ji); len(rt) > 0 {
-		sub.logger.Warn("key is associated to marked users", slog.Any("types", rt))
+	// NB: Canaries are let through silently so whoever leaked them keeps using them.
+	canary := bs.kr.Canary()
+
+	jd := newJudge(app, bs, sr.GetString("subscription"))
+	jd.judge(RULE_VERSION, checkVersion(&ir.SubInfo.VersionInfo))
+	jd.judge(RULE_BLACKLIST, checkBlacklist(app, sub.ip, &fi, &si))
+	jd.judge(RULE_DEVICE, checkDevice(app, bs.kr, &dv))
+	jd.judge(RULE_MISMATCH, checkMismatch(&fi, fr, ar, &ai, bs.en))
+	jd.judge(RULE_ASSOSIATION, checkAssosiation(&ji)...)
+	jd.judge(RULE_NETWORK, checkNetwork(&ni)...)
+	jd.judge(RULE_GEO, checkGeo(&ai, &ni, sub.timestamp)...)
+	jd.judge(RULE_TRAVEL, checkTravel(app, bs.kr, sub.uuid.String(), &ni, sub.timestamp))
+
+	if err := jd.record(sub); err != nil {
+		sub.logger.Error("failed to record verdicts", slog.String("error", err.Error()))
 	}
 
-	var state Bitmask
-
-	bfr, err := app.FindFirstRecordByFilter(
-		"fingerprint",
-		"key.bolo != false && (ipAddress = {:ipAddress})",
-		dbx.Params{"ipAddress": sub.ip},
-	)
+	if canary {
+		if _, err := openIncident(sub, bs, sr.GetString("subscription"), SEVERITY_CANARY, []string{"canary"}, &IncidentMatches{}, &ir, &ni); err != nil {
+			sub.logger.Error("failed to open incident", slog.String("error", err.Error()))
+		}
 
-	if bfr != nil && err == nil {
-		state.AddFlag(BOLO_SESSION)
+		if err := bs.alert(sub, ACTION_CANARY, "canary key was used"); err != nil {
+			sub.logger.Error("failed to queue alert", slog.String("error", err.Error()))
+		}
+	} else if enforced, err := jd.enforce(sub); enforced {
+		return err
 	}
 
-	bsr, err := app.FindFirstRecordByFilter(
-		"sessions",
-		"subscription.key.bolo == true && (cpuStart = {:cpuStart} || playSessionId = {:playSessionId} || robloxSessionId = {:robloxSessionId})",
-		dbx.Params{"robloxSessionId": si.RobloxSessionId, "playSessionId": si.PlaySessionId, "cpuStart": toFixed(float64(pk.Timestamp)-si.OsClock, 2)},
-	)
-
-	if bsr != nil && err == nil {
-		state.AddFlag(BOLO_SESSION)
-	}
+	state, matches := checkBolo(app, sub.ip, toFixed(float64(pk.Timestamp)-si.OsClock, 2), &si, &ji, bs.pr.WorkspaceThreshold())
 
-	bjr, err := app.FindFirstRecordByFilter(
-		"joins",
-		"subscription.key.bolo == true && userId = {:userId}",
-		dbx.Params{"userId": ji.UserId},
-	)
+	if state != 0x0 {
+		if _, err := openIncident(sub, bs, jr.GetString("subscription"), SEVERITY_BOLO, boloFlags(state), &matches, &ir, &ni); err != nil {
+			sub.logger.Error("failed to open incident", slog.String("error", err.Error()))
+		}
 
-	if bjr != nil && err == nil {
-		state.AddFlag(BOLO_JOIN)
+		if err := bs.alert(sub, ACTION_BOLO, fmt.Sprintf("matched bolo key (%d)", state)); err != nil {
+			sub.logger.Error("failed to queue alert", slog.String("error", err.Error()))
+		}
 	}
 
-	bsrl, err := app.FindRecordsByFilter(
-		"sessions",
-		"subscription.key.bolo == true",
-		"", 0, 0, dbx.Params{},
-	)
-
-	if err == nil && partialMatchSessions(si.WorkspaceScan, bsrl) {
-		state.AddFlag(BOLO_WORKSPACE)
+	probes, err := pickProbes(sub, bs)
+	if err != nil {
+		return err
 	}
 
-	if state != 0x0 {
-		bs.alert(sub, ACTION_BOLO)
-	}
+	pb := prober{id: id, sbid: sr.GetString("subscription"), probes: probes}
 
 	sub.state.AddFlag(STATE_IDENTIFIED)
-	sub.handler = loader{id: id}
+	sub.handler = pb
 
-	return id.hs.message(sub, Message{Id: PacketIdIdentify, Data: IdentifyResponse{
-		CurrentRole: bs.kr.GetString("role"),
+	err = id.hs.message(sub, Message{Id: PacketIdIdentify, Data: IdentifyResponse{
+		CurrentRole:     bs.kr.GetString("role"),
+		FreezeThreshold: bs.pr.FreezePolicy().Threshold,
+		Permissions:     bs.pm,
 	}})
+
+	if err != nil {
+		return err
+	}
+
+	return pb.challenge(sub)
 }
 
 func (ir identifier) packet() byte {
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"armorshield/ipintel"
+	"armorshield/record"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Review status of an incident.
+const (
+	INCIDENT_OPEN          = "open"
+	INCIDENT_INVESTIGATING = "investigating"
+	INCIDENT_ACTIONED      = "actioned"
+	INCIDENT_DISMISSED     = "dismissed"
+)
+
+// Actions a reviewer can take on an actioned incident.
+const (
+	INCIDENT_ACTION_NONE      = ""
+	INCIDENT_ACTION_BOLO      = "bolo"
+	INCIDENT_ACTION_BAN       = "ban"
+	INCIDENT_ACTION_BLACKLIST = "blacklist"
+)
+
+// How long a ban from an incident lasts if the reviewer doesn't specify it.
+const DEFAULT_INCIDENT_BAN time.Duration = 24 * time.Hour
+
+// Records of bolo keys that a detection matched against.
+type IncidentMatches struct {
+	Fingerprint *core.Record
+	Session     *core.Record
+	Join        *core.Record
+	Workspace   *core.Record
+}
+
+// Everything the subscription sent when it identified.
+type IncidentSnapshot struct {
+	Ip       string
+	Network  *ipintel.Info
+	Request  *IdentifyRequest
+	Flags    []string
+	Observed time.Time
+}
+
+func boloFlags(state Bitmask) []string {
+	flags := []string{}
+
+	if state.HasFlag(BOLO_SESSION) {
+		flags = append(flags, "session")
+	}
+
+	if state.HasFlag(BOLO_JOIN) {
+		flags = append(flags, "join")
+	}
+
+	if state.HasFlag(BOLO_WORKSPACE) {
+		flags = append(flags, "workspace")
+	}
+
+	return flags
+}
+
+func recordId(rec *core.Record) string {
+	if rec == nil {
+		return ""
+	}
+
+	return rec.Id
+}
+
+// Open an incident for review of a detection during identify.
+func openIncident(sub *subscription, bs *bootstrapper, sbid string, severity string, flags []string, matches *IncidentMatches, ir *IdentifyRequest, ni *ipintel.Info) (*core.Record, error) {
+	if bs.kr == nil || bs.pr == nil {
+		return nil, errors.New("bootstrapper is not initialized")
+	}
+
+	snapshot, err := json.Marshal(IncidentSnapshot{
+		Ip:       sub.ip,
+		Network:  ni,
+		Request:  ir,
+		Flags:    flags,
+		Observed: sub.timestamp,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Create(sub.app, "incidents", map[string]any{
+		"key":              bs.kr.Id,
+		"project":          bs.pr.Id,
+		"subscription":     sbid,
+		"flags":            flags,
+		"fingerprint":      recordId(matches.Fingerprint),
+		"session":          recordId(matches.Session),
+		"join":             recordId(matches.Join),
+		"workspaceSession": recordId(matches.Workspace),
+		"snapshot":         string(snapshot),
+		"severity":         severity,
+		"status":           INCIDENT_OPEN,
+	})
+}
+
+// What linked a key to a newly blacklisted or bolo key.
+type LinkSnapshot struct {
+	Source   string
+	Links    []string
+	Observed time.Time
+}
+
+// Open an incident for review of a key linked to a newly blacklisted or bolo key.
+func openLinkedIncident(app *pocketbase.PocketBase, kr *Key, pr *Project, source *Key, action Action, links []string) (*core.Record, error) {
+	snapshot, err := json.Marshal(LinkSnapshot{
+		Source:   source.Id,
+		Links:    links,
+		Observed: time.Now(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Create(app, "incidents", map[string]any{
+		"key":      kr.Id,
+		"project":  pr.Id,
+		"source":   source.Id,
+		"flags":    links,
+		"snapshot": string(snapshot),
+		"severity": action.Severity(),
+		"status":   INCIDENT_OPEN,
+	})
+}
+
+// Apply the reviewer's action of an actioned incident to it's key.
+// NB: Actions are applied once, later edits of an applied incident are ignored.
+func applyIncident(app *pocketbase.PocketBase, ir *core.Record) error {
+	if ir.GetString("status") != INCIDENT_ACTIONED || !ir.GetDateTime("appliedAt").IsZero() {
+		return nil
+	}
+
+	kr, err := FindKeyById(app, ir.GetString("key"))
+	if err != nil {
+		return err
+	}
+
+	switch ir.GetString("action") {
+	case INCIDENT_ACTION_BOLO:
+		kr.Set("bolo", true)
+	case INCIDENT_ACTION_BAN:
+		duration := time.Duration(ir.GetFloat("banHours") * float64(time.Hour))
+		if duration <= 0 {
+			duration = DEFAULT_INCIDENT_BAN
+		}
+
+		until, err := types.ParseDateTime(time.Now().Add(duration))
+		if err != nil {
+			return err
+		}
+
+		kr.Set("bannedUntil", until)
+	case INCIDENT_ACTION_BLACKLIST:
+		kr.Set("blacklist", "incident "+ir.Id)
+	case INCIDENT_ACTION_NONE:
+		return nil
+	default:
+		return errors.New("unknown incident action")
+	}
+
+	if err := app.Save(kr); err != nil {
+		return err
+	}
+
+	ir.Set("appliedAt", types.NowDateTime())
+
+	return app.Save(ir)
+}
@@ -0,0 +1,462 @@
+package ipintel
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Database files that are looked for inside of the directory.
+// Every file is optional, and a missing file results in an empty table.
+// NB: A MMDB database takes priority over the CSV database of the same kind.
+const (
+	FILE_ASN_MMDB = "GeoLite2-ASN.mmdb"
+
+	FILE_COUNTRY_MMDB = "GeoLite2-Country.mmdb"
+
+	FILE_CITY_MMDB = "GeoLite2-City.mmdb"
+
+	// network,asn,organization
+	FILE_ASN = "asn.csv"
+
+	// network,country
+	FILE_COUNTRY = "country.csv"
+
+	// network,latitude,longitude,timezone
+	FILE_LOCATION = "location.csv"
+
+	// network[,provider]
+	FILE_VPN = "vpn.csv"
+
+	// network[,provider]
+	FILE_DATACENTER = "datacenter.csv"
+)
+
+// Result of looking up an address.
+type Info struct {
+	ASN          uint32
+	Organization string
+	Country      string
+	VPN          bool
+	Datacenter   bool
+
+	// Geolocation of the address.
+	// NB: Only valid if 'Located' is set.
+	Located   bool
+	Latitude  float64
+	Longitude float64
+	TimeZone  string
+}
+
+type asn struct {
+	number       uint32
+	organization string
+}
+
+type location struct {
+	latitude  float64
+	longitude float64
+	timezone  string
+}
+
+type mmdbASN struct {
+	Number       uint32 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type mmdbCountry struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type mmdbCity struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+}
+
+// An offline IP intelligence database loaded from local files.
+type Database struct {
+	dir string
+
+	// Loaded tables and it's mutex.
+	mu         sync.RWMutex
+	asnDB      *maxminddb.Reader
+	countryDB  *maxminddb.Reader
+	cityDB     *maxminddb.Reader
+	asn        table[asn]
+	country    table[string]
+	location   table[location]
+	vpn        table[string]
+	datacenter table[string]
+
+	// Modification times of the loaded files.
+	mods map[string]time.Time
+}
+
+func New(dir string) *Database {
+	return &Database{dir: dir, mods: make(map[string]time.Time)}
+}
+
+// Open a database file and feed each of it's rows.
+// NB: The first column of each row must be a network in CIDR notation or a single address.
+func readFile(path string, row func(pf netip.Prefix, cols []string) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	rd := csv.NewReader(file)
+	rd.FieldsPerRecord = -1
+	rd.Comment = '#'
+	rd.TrimLeadingSpace = true
+
+	for {
+		cols, err := rd.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		pf, err := parseNetwork(cols[0])
+		if err != nil {
+			// Skip headers and malformed rows.
+			continue
+		}
+
+		if err := row(pf, cols[1:]); err != nil {
+			return err
+		}
+	}
+}
+
+func parseNetwork(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	pf, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	addr := pf.Addr()
+	if addr.Is4In6() && pf.Bits() >= 96 {
+		return netip.PrefixFrom(addr.Unmap(), pf.Bits()-96).Masked(), nil
+	}
+
+	return pf.Masked(), nil
+}
+
+func column(cols []string, idx int) string {
+	if idx >= len(cols) {
+		return ""
+	}
+
+	return strings.TrimSpace(cols[idx])
+}
+
+func loadMMDB(path string) (*maxminddb.Reader, error) {
+	ba, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return maxminddb.FromBytes(ba)
+}
+
+func loadList(path string) (table[string], error) {
+	t := table[string]{}
+
+	err := readFile(path, func(pf netip.Prefix, cols []string) error {
+		t = append(t, entry[string]{lo: pf.Addr(), hi: last(pf), val: column(cols, 0)})
+		return nil
+	})
+
+	t = t.flatten()
+
+	return t, err
+}
+
+func loadCountry(path string) (table[string], error) {
+	t := table[string]{}
+
+	err := readFile(path, func(pf netip.Prefix, cols []string) error {
+		t = append(t, entry[string]{lo: pf.Addr(), hi: last(pf), val: strings.ToUpper(column(cols, 0))})
+		return nil
+	})
+
+	t = t.flatten()
+
+	return t, err
+}
+
+func loadLocation(path string) (table[location], error) {
+	t := table[location]{}
+
+	err := readFile(path, func(pf netip.Prefix, cols []string) error {
+		lat, err := strconv.ParseFloat(column(cols, 0), 64)
+		if err != nil {
+			return nil
+		}
+
+		long, err := strconv.ParseFloat(column(cols, 1), 64)
+		if err != nil {
+			return nil
+		}
+
+		t = append(t, entry[location]{lo: pf.Addr(), hi: last(pf), val: location{latitude: lat, longitude: long, timezone: column(cols, 2)}})
+		return nil
+	})
+
+	t = t.flatten()
+
+	return t, err
+}
+
+func loadASN(path string) (table[asn], error) {
+	t := table[asn]{}
+
+	err := readFile(path, func(pf netip.Prefix, cols []string) error {
+		num, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(column(cols, 0)), "AS"), 10, 32)
+		if err != nil {
+			return nil
+		}
+
+		t = append(t, entry[asn]{lo: pf.Addr(), hi: last(pf), val: asn{number: uint32(num), organization: column(cols, 1)}})
+		return nil
+	})
+
+	t = t.flatten()
+
+	return t, err
+}
+
+// Modification times of every database file in the directory.
+func (db *Database) stat() map[string]time.Time {
+	mods := make(map[string]time.Time)
+
+	for _, name := range []string{FILE_ASN_MMDB, FILE_COUNTRY_MMDB, FILE_CITY_MMDB, FILE_ASN, FILE_COUNTRY, FILE_LOCATION, FILE_VPN, FILE_DATACENTER} {
+		fi, err := os.Stat(filepath.Join(db.dir, name))
+		if err != nil {
+			continue
+		}
+
+		mods[name] = fi.ModTime()
+	}
+
+	return mods
+}
+
+// Load every database file from disk and swap them in.
+func (db *Database) Load() error {
+	mods := db.stat()
+
+	adb, err := loadMMDB(filepath.Join(db.dir, FILE_ASN_MMDB))
+	if err != nil {
+		return err
+	}
+
+	cdb, err := loadMMDB(filepath.Join(db.dir, FILE_COUNTRY_MMDB))
+	if err != nil {
+		return err
+	}
+
+	ldb, err := loadMMDB(filepath.Join(db.dir, FILE_CITY_MMDB))
+	if err != nil {
+		return err
+	}
+
+	at, err := loadASN(filepath.Join(db.dir, FILE_ASN))
+	if err != nil {
+		return err
+	}
+
+	ct, err := loadCountry(filepath.Join(db.dir, FILE_COUNTRY))
+	if err != nil {
+		return err
+	}
+
+	lt, err := loadLocation(filepath.Join(db.dir, FILE_LOCATION))
+	if err != nil {
+		return err
+	}
+
+	vt, err := loadList(filepath.Join(db.dir, FILE_VPN))
+	if err != nil {
+		return err
+	}
+
+	dt, err := loadList(filepath.Join(db.dir, FILE_DATACENTER))
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	db.asnDB = adb
+	db.countryDB = cdb
+	db.cityDB = ldb
+	db.asn = at
+	db.country = ct
+	db.location = lt
+	db.vpn = vt
+	db.datacenter = dt
+	db.mods = mods
+	db.mu.Unlock()
+
+	return nil
+}
+
+// Check if any of the database files changed since the last load.
+func (db *Database) changed() bool {
+	mods := db.stat()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if len(mods) != len(db.mods) {
+		return true
+	}
+
+	for name, mt := range mods {
+		if !db.mods[name].Equal(mt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Poll the database files and reload them when they change.
+// NB: This function blocks until the context is done.
+func (db *Database) Watch(ctx context.Context, interval time.Duration, onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !db.changed() {
+				continue
+			}
+
+			if err := db.Load(); err != nil && onError != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Lookup everything we know about an address.
+func (db *Database) Lookup(ip string) Info {
+	info := Info{}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return info
+	}
+
+	addr = addr.Unmap().WithZone("")
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.asnDB != nil {
+		var rec mmdbASN
+		if err := db.asnDB.Lookup(net.IP(addr.AsSlice()), &rec); err == nil {
+			info.ASN = rec.Number
+			info.Organization = rec.Organization
+		}
+	} else if val, ok := db.asn.find(addr); ok {
+		info.ASN = val.number
+		info.Organization = val.organization
+	}
+
+	if db.countryDB != nil {
+		var rec mmdbCountry
+		if err := db.countryDB.Lookup(net.IP(addr.AsSlice()), &rec); err == nil {
+			info.Country = rec.Country.IsoCode
+		}
+	} else if val, ok := db.country.find(addr); ok {
+		info.Country = val
+	}
+
+	if db.cityDB != nil {
+		var rec mmdbCity
+		if err := db.cityDB.Lookup(net.IP(addr.AsSlice()), &rec); err == nil && len(rec.Location.TimeZone) > 0 {
+			info.Located = true
+			info.Latitude = rec.Location.Latitude
+			info.Longitude = rec.Location.Longitude
+			info.TimeZone = rec.Location.TimeZone
+		}
+
+		if len(info.Country) <= 0 {
+			info.Country = rec.Country.IsoCode
+		}
+	} else if val, ok := db.location.find(addr); ok {
+		info.Located = true
+		info.Latitude = val.latitude
+		info.Longitude = val.longitude
+		info.TimeZone = val.timezone
+	}
+
+	_, info.VPN = db.vpn.find(addr)
+	_, info.Datacenter = db.datacenter.find(addr)
+
+	return info
+}
+
+// Great-circle distance in kilometers between two coordinates.
+func Distance(lat1 float64, long1 float64, lat2 float64, long2 float64) float64 {
+	const radius = 6371.0
+
+	dlat := (lat2 - lat1) * math.Pi / 180
+	dlong := (long2 - long1) * math.Pi / 180
+
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dlong/2)*math.Sin(dlong/2)
+
+	return radius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
@@ -0,0 +1,105 @@
+package ipintel
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// A range of addresses and the value attached to it.
+type entry[T any] struct {
+	lo  netip.Addr
+	hi  netip.Addr
+	val T
+}
+
+// Sorted list of non-overlapping address ranges.
+type table[T any] []entry[T]
+
+// Last address inside of a prefix.
+func last(pf netip.Prefix) netip.Addr {
+	ba := pf.Addr().AsSlice()
+	bits := pf.Bits()
+
+	for i := range ba {
+		for j := 0; j < 8; j++ {
+			if i*8+j < bits {
+				continue
+			}
+
+			ba[i] |= 0x80 >> j
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(ba)
+	return addr
+}
+
+// Sort the ranges and flatten nested ones, so every address falls into exactly one range.
+// NB: The most specific range wins, a /16 inside of a /8 splits the /8 around it.
+func (t table[T]) flatten() table[T] {
+	sort.SliceStable(t, func(i, j int) bool {
+		if t[i].lo == t[j].lo {
+			return t[j].hi.Less(t[i].hi)
+		}
+
+		return t[i].lo.Less(t[j].lo)
+	})
+
+	out := table[T]{}
+	stack := []entry[T]{}
+
+	var cursor netip.Addr
+
+	emit := func(hi netip.Addr, val T) {
+		if cursor.IsValid() && !hi.Less(cursor) {
+			out = append(out, entry[T]{lo: cursor, hi: hi, val: val})
+		}
+	}
+
+	// Close the innermost open range and continue it's parent after it.
+	pop := func() {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		emit(top.hi, top.val)
+		cursor = top.hi.Next()
+	}
+
+	for _, ent := range t {
+		for len(stack) > 0 && stack[len(stack)-1].hi.Less(ent.lo) {
+			pop()
+		}
+
+		if len(stack) > 0 {
+			emit(ent.lo.Prev(), stack[len(stack)-1].val)
+		}
+
+		cursor = ent.lo
+		stack = append(stack, ent)
+	}
+
+	for len(stack) > 0 {
+		pop()
+	}
+
+	return out
+}
+
+func (t table[T]) find(addr netip.Addr) (T, bool) {
+	var zero T
+
+	idx := sort.Search(len(t), func(i int) bool {
+		return addr.Less(t[i].lo)
+	})
+
+	if idx == 0 {
+		return zero, false
+	}
+
+	ent := t[idx-1]
+	if ent.hi.Less(addr) {
+		return zero, false
+	}
+
+	return ent.val, true
+}
@@ -0,0 +1,69 @@
+package ipintel
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func testTable(prefixes ...string) table[string] {
+	t := table[string]{}
+
+	for _, s := range prefixes {
+		pf := netip.MustParsePrefix(s)
+		t = append(t, entry[string]{lo: pf.Addr(), hi: last(pf), val: s})
+	}
+
+	return t.flatten()
+}
+
+func TestFindNested(t *testing.T) {
+	tb := testTable("10.1.0.0/16", "10.0.0.0/8", "10.1.2.0/24", "192.168.0.0/16", "2001:db8::/32")
+
+	cases := map[string]string{
+		"10.0.0.1":       "10.0.0.0/8",
+		"10.1.0.1":       "10.1.0.0/16",
+		"10.1.2.3":       "10.1.2.0/24",
+		"10.1.3.0":       "10.1.0.0/16",
+		"10.200.0.1":     "10.0.0.0/8",
+		"10.255.255.255": "10.0.0.0/8",
+		"192.168.1.1":    "192.168.0.0/16",
+		"2001:db8::1":    "2001:db8::/32",
+	}
+
+	for addr, want := range cases {
+		got, ok := tb.find(netip.MustParseAddr(addr))
+		if !ok || got != want {
+			t.Errorf("find(%s) = %q, %t, want %q", addr, got, ok, want)
+		}
+	}
+
+	for _, addr := range []string{"9.255.255.255", "11.0.0.0", "172.16.0.1", "2001:db9::1"} {
+		if got, ok := tb.find(netip.MustParseAddr(addr)); ok {
+			t.Errorf("find(%s) = %q, want no match", addr, got)
+		}
+	}
+}
+
+func TestFlattenEdges(t *testing.T) {
+	tb := testTable("0.0.0.0/0", "255.255.255.0/24", "0.0.0.0/24")
+
+	cases := map[string]string{
+		"0.0.0.1":         "0.0.0.0/24",
+		"0.0.1.0":         "0.0.0.0/0",
+		"128.0.0.0":       "0.0.0.0/0",
+		"255.255.255.255": "255.255.255.0/24",
+	}
+
+	for addr, want := range cases {
+		got, ok := tb.find(netip.MustParseAddr(addr))
+		if !ok || got != want {
+			t.Errorf("find(%s) = %q, %t, want %q", addr, got, ok, want)
+		}
+	}
+
+	for i := 1; i < len(tb); i++ {
+		if !tb[i-1].hi.Less(tb[i].lo) {
+			t.Fatalf("ranges %v and %v overlap", tb[i-1], tb[i])
+		}
+	}
+}
@@ -60,8 +60,19 @@ func (kr *Key) Expired(ts time.Time) bool {
 	return date.Time().Before(ts)
 }
 
+// Check if the key is temporarily banned at the given time.
+func (kr *Key) Banned(ts time.Time) bool {
+	return kr.GetDateTime("bannedUntil").Time().After(ts)
+}
+
+// Check if the key is a canary that was leaked on purpose.
+func (kr *Key) Canary() bool {
+	return kr.GetBool("canary")
+}
+
+// Check if the key was blacklisted, the field holds the reason.
 func (kr *Key) Blacklisted() bool {
-	return len(kr.GetString("blacklisted")) > 0
+	return len(kr.GetString("blacklist")) > 0
 }
 
 func (kr *Key) DiscordId() (string, error) {
@@ -1,7 +1,10 @@
 package main
 
 import (
-	"github.com/pocketbase/dbx"
+	"errors"
+	"log/slog"
+
+	"github.com/pocketbase/pocketbase/core"
 )
 
 type loader struct {
@@ -17,30 +20,105 @@ func (ld loader) handle(sub *subscription, pk Packet) error {
 		return err
 	}
 
-	bs := ld.id.hs.bs
+	bs := sub.bootstrapper
 	gid := lr.GameId
 	hs := ld.id.hs
 	kr := bs.kr
 
-	sr, err := sub.app.FindFirstRecordByFilter("scripts", "project = {:projectId} && game = {:gameId}", dbx.Params{
-		"projectId": bs.pr.Id,
-		"gameId":    gid,
-	})
+	sr, vid, err := pickVersion(sub.app, bs.pr, kr, &bs.pm, &lr)
+
+	// NB: The script only runs sealed from the loader in it's current version, pins are streamed.
+	sealed := err == nil && vid == sr.GetString("version")
+
+	// NB: Canaries may be served a decoy so the script of whoever leaked them can be told apart.
+	if kr.Canary() {
+		if dsr, derr := decoyScript(sub, kr, bs.pr); derr == nil {
+			sr, vid, err, sealed = dsr, dsr.GetString("version"), nil, false
+		}
+	}
 
 	if err != nil {
 		return sub.close("no script for your current game")
 	}
 
-	if kr.GetString("role") == "pentest" && gid != BASEPLATE_GAME_ID {
-		return sub.close("pentester roles can only load in a baseplate game")
+	if !bs.pm.AllowsGame(gid) && enforced(sub, kr, "your role can not load in this game") {
+		return sub.close("your role can not load in this game")
+	}
+
+	if !bs.pm.AllowsChannel(sr.GetString("channel")) && enforced(sub, kr, "your role can not load this script") {
+		return sub.close("your role can not load this script")
+	}
+
+	modules, err := scriptModules(sub.app, bs.pr, kr, &bs.pm, sr, vid)
+	if err != nil && enforced(sub, kr, err.Error()) {
+		return sub.close(err.Error())
 	}
 
+	resp := loadResponse(sub, hs, sr, vid, modules, sealed)
+
+	sub.script = sr.Id
 	sub.state.AddFlag(STATE_LOADED)
 	sub.logger.Info("script loaded")
 
-	return hs.message(sub, Message{Id: PacketIdLoad, Data: LoadResponse{
-		ScriptId: sr.Id,
-	}})
+	if ap := bs.pr.AttestPolicy(); ap.Interval > 0 {
+		sub.attester = newAttester(hs, ap)
+		go sub.attester.run(sub.ctx, sub)
+	}
+
+	return hs.message(sub, Message{Id: PacketIdLoad, Data: resp})
+}
+
+// Prepare the modules of a script for streaming and release the keys of the sealed ones.
+// NB: Decoys go through here as well, so they load exactly like a real script.
+// They aren't part of the loader the client runs, so they are never sealed.
+func loadResponse(sub *subscription, hs handshaker, sr *core.Record, vid string, modules []LoadModule, sealed bool) LoadResponse {
+	bs := sub.bootstrapper
+
+	// Modules that can't be streamed fall back to the bundled scripts.
+	sub.streamer = newStreamer(hs)
+	sub.streamer.mark, sub.streamer.marked = watermarkFor(sub, bs.kr, bs.pr)
+
+	for idx := range modules {
+		// NB: The script itself ships sealed in it's loader, unless it has to be watermarked.
+		// Libraries aren't part of the loader, so they are always streamed.
+		if modules[idx].ScriptId == sr.Id && sealed && !sub.streamer.marked {
+			continue
+		}
+
+		if err := sub.streamer.add(sub.app, &modules[idx]); err != nil {
+			sub.logger.Warn("module not streamed", slog.String("script", modules[idx].ScriptId), slog.String("err", err.Error()))
+			continue
+		}
+
+		if !modules[idx].Streamed || !sub.streamer.marked {
+			continue
+		}
+
+		if err := recordWatermark(sub, bs.kr, bs.pr, &modules[idx], sub.streamer.mark); err != nil {
+			sub.logger.Warn("failed to record watermark", slog.String("script", modules[idx].ScriptId), slog.String("err", err.Error()))
+		}
+	}
+
+	return LoadResponse{
+		ScriptId:   sr.Id,
+		VersionId:  vid,
+		Modules:    modules,
+		UnsealKeys: unsealKeys(sub.app, modules),
+	}
+}
+
+// The decoy script of a canary key, or of it's project.
+func decoyScript(sub *subscription, kr *Key, pr *Project) (*core.Record, error) {
+	did := kr.GetString("decoyScript")
+	if len(did) <= 0 {
+		did = pr.GetString("decoyScript")
+	}
+
+	if len(did) <= 0 {
+		return nil, errors.New("no decoy script")
+	}
+
+	return sub.app.FindRecordById("scripts", did)
 }
 
 func (ld loader) packet() byte {
@@ -48,5 +126,5 @@ func (ld loader) packet() byte {
 }
 
 func (ld loader) state(sub *subscription) bool {
-	return sub.state.HasFlag(STATE_IDENTIFIED) && !sub.state.HasFlag(STATE_LOADED)
+	return sub.state.HasFlag(STATE_CHECKED) && !sub.state.HasFlag(STATE_LOADED)
 }
@@ -4,54 +4,139 @@ package main
 
 import (
 	"armorshield/preprocessor"
+	"context"
 	"log"
+	"log/slog"
+	"os"
+	"time"
 
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
 )
 
 func main() {
+	// Preprocessor workers only run the native library, they must not bootstrap the app.
+	if len(os.Args) > 1 && os.Args[1] == preprocessor.WORKER_COMMAND {
+		os.Exit(preprocessor.RunWorker(os.Stdin, os.Stdout))
+	}
+
 	app := pocketbase.New()
 
 	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
 		sv := newServer(app)
 
+		if err := sv.intel.Load(); err != nil {
+			app.Logger().Error("failed to load ip intelligence", slog.String("error", err.Error()))
+		}
+
+		go sv.intel.Watch(context.Background(), 30*time.Second, func(err error) {
+			app.Logger().Error("failed to reload ip intelligence", slog.String("error", err.Error()))
+		})
+
+		pq := preprocessor.NewQueue(app, preprocessor.DEFAULT_WORKERS)
+		go pq.Run(context.Background())
+
+		if err := pq.Requeue(); err != nil {
+			app.Logger().Error("failed to requeue scripts", slog.String("error", err.Error()))
+		}
+
+		app.OnRecordCreate("scripts").BindFunc(pendProtection)
+		app.OnRecordUpdate("scripts").BindFunc(pendProtection)
+
 		app.OnRecordAfterCreateSuccess("scripts").BindFunc(func(e *core.RecordEvent) error {
-			return preprocessor.Update(app, e.Record)
+			if preprocessor.NeedsProtection(e.Record) {
+				pq.Enqueue(e.Record.Id)
+			}
+
+			return e.Next()
 		})
 
 		app.OnRecordAfterUpdateSuccess("scripts").BindFunc(func(e *core.RecordEvent) error {
-			return preprocessor.Update(app, e.Record)
+			if preprocessor.NeedsProtection(e.Record) {
+				pq.Enqueue(e.Record.Id)
+			}
+
+			return e.Next()
 		})
 
+		app.OnRecordUpdate("versions").BindFunc(protectVersion)
+
 		app.OnRecordAfterUpdateSuccess("keys").BindFunc(func(e *core.RecordEvent) error {
 			key := &Key{}
 			key.SetProxyRecord(e.Record)
 
-			sub := sv.find(key)
-			if sub == nil {
-				return nil
+			if rescanNeeded(e.Record) {
+				go func() {
+					if err := rescan(app, sv, key); err != nil {
+						app.Logger().Error("failed to re-scan linked keys", slog.String("error", err.Error()))
+					}
+				}()
 			}
 
-			if key.Blacklisted() {
-				return sub.close("key got blacklisted")
+			for _, sub := range sv.findByKey(key) {
+				sub.dispatch(func() error {
+					if key.Blacklisted() {
+						return sub.close("key got blacklisted")
+					}
+
+					if key.Banned(time.Now()) {
+						return sub.close("key got temporarily banned")
+					}
+
+					return pushPermissions(sub, key)
+				})
 			}
 
-			if !sub.state.HasFlag(STATE_LOADED) {
-				return nil
+			return nil
+		})
+
+		app.OnRecordAfterUpdateSuccess("roles").BindFunc(func(e *core.RecordEvent) error {
+			for _, sub := range sv.findByRole(e.Record.GetString("project"), e.Record.GetString("name")) {
+				sub.dispatch(func() error {
+					if err := pushPermissions(sub, sub.bootstrapper.kr); err != nil {
+						app.Logger().Error("failed to push permissions", slog.String("error", err.Error()))
+					}
+
+					return nil
+				})
+			}
+
+			return nil
+		})
+
+		app.OnRecordAfterUpdateSuccess("incidents").BindFunc(func(e *core.RecordEvent) error {
+			return applyIncident(app, e.Record)
+		})
+
+		go runOutbox(context.Background(), app)
+
+		app.Cron().MustAdd("alertDigest", "*/30 * * * *", func() {
+			if err := digestAlerts(app); err != nil {
+				app.Logger().Error("failed to send alert digest", slog.String("error", err.Error()))
 			}
+		})
 
-			return sub.handshaker.message(sub, Message{
-				Id:   PacketIdKeyUpdate,
-				Data: KeyUpdatePacket{Role: key.GetString("role")},
-			})
+		app.Cron().MustAdd("clusters", "*/15 * * * *", func() {
+			if err := updateClusters(app); err != nil {
+				app.Logger().Error("failed to update key clusters", slog.String("error", err.Error()))
+			}
 		})
 
 		se.Router.GET("/subscribe", sv.subscribe)
 
+		bindRuleReport(app, se)
+		bindBacktest(app, sv, se)
+		bindRollback(app, se)
+		bindVersionDiff(app, se)
+		bindSealRotate(app, se)
+		bindProtect(app, pq, se)
+
 		return se.Next()
 	})
 
+	app.RootCmd.AddCommand(backtestCommand(app))
+	app.RootCmd.AddCommand(traceCommand(app))
+
 	if err := app.Start(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,146 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"time"
+
+	discordwebhook "github.com/bensch777/discord-webhook-golang"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+// Timeout for a single delivery over HTTP.
+const HTTP_TIMEOUT = 10 * time.Second
+
+// An alert about a subscription.
+type Alert struct {
+	Title          string
+	Severity       string
+	Reason         string
+	Description    string
+	Color          int
+	Mention        bool
+	KeyId          string
+	DiscordId      string
+	SubscriptionId string
+	Timestamp      time.Time
+}
+
+// A destination that alerts can be delivered to.
+type Notifier interface {
+	Notify(ctx context.Context, alert *Alert) error
+}
+
+var client = &http.Client{Timeout: HTTP_TIMEOUT}
+
+func post(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook responded with %d: %s", resp.StatusCode, body)
+	}
+
+	return nil
+}
+
+// Maximum length of the description of a Discord embed.
+const DISCORD_DESCRIPTION_LIMIT = 4096
+
+// Delivers alerts as a Discord webhook embed.
+type Discord struct {
+	Url string
+}
+
+func (dn Discord) Notify(ctx context.Context, alert *Alert) error {
+	// NB: Discord rejects the whole embed if the description is too long, so cut it off instead.
+	desc := alert.Description
+	if rs := []rune(desc); len(rs) > DISCORD_DESCRIPTION_LIMIT {
+		desc = string(rs[:DISCORD_DESCRIPTION_LIMIT-3]) + "..."
+	}
+
+	embed := discordwebhook.Embed{
+		Title:       alert.Title,
+		Description: desc,
+		Color:       alert.Color,
+		Timestamp:   alert.Timestamp,
+		Footer: discordwebhook.Footer{
+			Text: fmt.Sprintf("Subscription ID: '%s'", alert.SubscriptionId),
+		},
+		Author: discordwebhook.Author{
+			Name: fmt.Sprintf("PB Key ID & Discord ID (%s) (%s)", alert.KeyId, alert.DiscordId),
+		},
+	}
+
+	hook := discordwebhook.Hook{
+		Username: "ArmorShield",
+		Embeds:   []discordwebhook.Embed{embed},
+	}
+
+	if alert.Mention {
+		hook.Content = "@everyone"
+	}
+
+	payload, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, dn.Url, payload)
+}
+
+// Delivers alerts as a plain JSON body.
+type Webhook struct {
+	Url string
+}
+
+func (wn Webhook) Notify(ctx context.Context, alert *Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, wn.Url, payload)
+}
+
+// Delivers alerts as an e-mail.
+type Smtp struct {
+	Mailer mailer.Mailer
+	From   mail.Address
+	To     []mail.Address
+}
+
+func (sn Smtp) Notify(ctx context.Context, alert *Alert) error {
+	text := fmt.Sprintf(
+		"%s\n\nKey ID: %s\nDiscord ID: %s\nSubscription ID: %s\nTimestamp: %s\n",
+		alert.Description,
+		alert.KeyId,
+		alert.DiscordId,
+		alert.SubscriptionId,
+		alert.Timestamp.Format(time.RFC3339),
+	)
+
+	return sn.Mailer.Send(&mailer.Message{
+		From:    sn.From,
+		To:      sn.To,
+		Subject: alert.Title,
+		Text:    text,
+	})
+}
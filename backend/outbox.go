@@ -0,0 +1,169 @@
+package main
+
+import (
+	"armorshield/notifier"
+	"armorshield/record"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/mail"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Kinds of notifiers an outbox entry can be delivered through.
+const (
+	NOTIFIER_DISCORD = "discord"
+	NOTIFIER_WEBHOOK = "webhook"
+	NOTIFIER_SMTP    = "smtp"
+)
+
+// Status of an outbox entry.
+const (
+	OUTBOX_PENDING = "pending"
+	OUTBOX_SENT    = "sent"
+	OUTBOX_FAILED  = "failed"
+)
+
+// Amount of delivery attempts before an entry is marked as failed.
+const OUTBOX_MAX_ATTEMPTS int = 8
+
+// Amount of entries delivered per poll.
+const OUTBOX_BATCH int = 32
+
+// How often the outbox is polled.
+const OUTBOX_POLL_INTERVAL = 5 * time.Second
+
+// Queue an alert for delivery through a single notifier.
+func queue(app *pocketbase.PocketBase, pr *Project, kind string, target string, alert *notifier.Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	_, err = record.Create(app, "outbox", map[string]any{
+		"project":     pr.Id,
+		"kind":        kind,
+		"target":      target,
+		"payload":     string(payload),
+		"status":      OUTBOX_PENDING,
+		"attempts":    0,
+		"nextAttempt": types.NowDateTime(),
+	})
+
+	return err
+}
+
+func newNotifier(app *pocketbase.PocketBase, kind string, target string) (notifier.Notifier, error) {
+	switch kind {
+	case NOTIFIER_DISCORD:
+		return notifier.Discord{Url: target}, nil
+	case NOTIFIER_WEBHOOK:
+		return notifier.Webhook{Url: target}, nil
+	case NOTIFIER_SMTP:
+		al, err := mail.ParseAddressList(target)
+		if err != nil {
+			return nil, err
+		}
+
+		to := []mail.Address{}
+		for _, addr := range al {
+			to = append(to, *addr)
+		}
+
+		meta := app.Settings().Meta
+
+		return notifier.Smtp{
+			Mailer: app.NewMailClient(),
+			From:   mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+			To:     to,
+		}, nil
+	}
+
+	return nil, errors.New("unknown notifier kind")
+}
+
+// Exponential backoff starting at 10 seconds and capped at an hour.
+func backoff(attempts int) time.Duration {
+	delay := time.Duration(math.Pow(2, float64(attempts))) * 10 * time.Second
+	return min(delay, time.Hour)
+}
+
+func deliver(ctx context.Context, app *pocketbase.PocketBase, ob *core.Record) error {
+	var alert notifier.Alert
+	if err := json.Unmarshal([]byte(ob.GetString("payload")), &alert); err != nil {
+		return err
+	}
+
+	nt, err := newNotifier(app, ob.GetString("kind"), ob.GetString("target"))
+	if err != nil {
+		return err
+	}
+
+	return nt.Notify(ctx, &alert)
+}
+
+// Deliver a batch of due outbox entries.
+func flushOutbox(ctx context.Context, app *pocketbase.PocketBase) error {
+	obl, err := app.FindRecordsByFilter(
+		"outbox",
+		"status = {:status} && nextAttempt <= {:now}",
+		"nextAttempt", OUTBOX_BATCH, 0,
+		dbx.Params{"status": OUTBOX_PENDING, "now": types.NowDateTime()},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	for _, ob := range obl {
+		err := deliver(ctx, app, ob)
+		attempts := ob.GetInt("attempts") + 1
+
+		ob.Set("attempts", attempts)
+
+		if err == nil {
+			ob.Set("status", OUTBOX_SENT)
+			ob.Set("error", "")
+			ob.Set("sentAt", types.NowDateTime())
+		} else {
+			ob.Set("error", err.Error())
+
+			if attempts >= OUTBOX_MAX_ATTEMPTS {
+				ob.Set("status", OUTBOX_FAILED)
+			}
+
+			next, _ := types.ParseDateTime(time.Now().Add(backoff(attempts)))
+			ob.Set("nextAttempt", next)
+		}
+
+		if err := app.Save(ob); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NB: This function blocks until the context is done.
+func runOutbox(ctx context.Context, app *pocketbase.PocketBase) {
+	ticker := time.NewTicker(OUTBOX_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := flushOutbox(ctx, app); err != nil {
+				app.Logger().Error("failed to flush outbox", slog.String("error", err.Error()))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
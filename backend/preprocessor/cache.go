@@ -0,0 +1,247 @@
+//go:build darwin || freebsd || linux || windows
+
+package preprocessor
+
+import (
+	"crypto/rc4"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"armorshield/bpool"
+	"armorshield/record"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// A protected output, the seal it was protected with and the preprocessed body it seals.
+type protection struct {
+	sealId string
+	key    []byte
+	output string
+	body   string
+}
+
+// Version of the preprocessor, the hash of it's library and the worker protocol.
+// NB: Rebuilding the library invalidates every cached output.
+func preprocessorVersion() (string, error) {
+	abs, err := libraryPath()
+	if err != nil {
+		return "", err
+	}
+
+	lib, err := os.Open(abs)
+	if err != nil {
+		return "", err
+	}
+
+	defer lib.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, lib); err != nil {
+		return "", err
+	}
+
+	binary.Write(h, binary.BigEndian, int64(WORKER_PROTOCOL))
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hash of everything a protected output depends on.
+func protectionHash(loader string, source string, pr *core.Record, scriptId string, version string) string {
+	h := sha256.New()
+
+	for _, part := range []string{loader, source, pr.GetString("salt"), pr.GetString("point"), scriptId, version} {
+		binary.Write(h, binary.BigEndian, uint64(len(part)))
+		h.Write([]byte(part))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Find a cached output for a hash.
+// NB: Outputs whose seal got revoked are never reused.
+func cachedProtection(app *pocketbase.PocketBase, hash string) (*protection, bool) {
+	cr, err := app.FindFirstRecordByFilter("protections", "hash = {:hash}", dbx.Params{"hash": hash})
+	if err != nil {
+		return nil, false
+	}
+
+	slr, err := app.FindRecordById("seals", cr.GetString("seal"))
+	if err != nil || slr.GetBool("revoked") {
+		return nil, false
+	}
+
+	sk, err := base64.StdEncoding.DecodeString(slr.GetString("key"))
+	if err != nil {
+		return nil, false
+	}
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return nil, false
+	}
+
+	defer fsys.Close()
+
+	blob, err := fsys.GetFile(cr.BaseFilesPath() + "/" + cr.GetString("output"))
+	if err != nil {
+		return nil, false
+	}
+
+	defer blob.Close()
+
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	if _, err := b.ReadFrom(blob); err != nil {
+		return nil, false
+	}
+
+	// NB: Outputs cached before bodies were kept can't be streamed, so they are protected again.
+	if len(cr.GetString("body")) <= 0 {
+		return nil, false
+	}
+
+	bblob, err := fsys.GetFile(cr.BaseFilesPath() + "/" + cr.GetString("body"))
+	if err != nil {
+		return nil, false
+	}
+
+	defer bblob.Close()
+
+	bb := bpool.Get()
+	defer bpool.Put(bb)
+
+	if _, err := bb.ReadFrom(bblob); err != nil {
+		return nil, false
+	}
+
+	cr.Set("hits", cr.GetInt("hits")+1)
+	cr.Set("lastHit", types.NowDateTime())
+
+	if err := app.Save(cr); err != nil {
+		app.Logger().Warn("failed to update cached protection", slog.String("hash", hash), slog.String("error", err.Error()))
+	}
+
+	return &protection{sealId: cr.GetString("sealId"), key: sk, output: b.String(), body: bb.String()}, true
+}
+
+// Cache a protected output under it's hash, replacing whatever was cached before.
+func storeProtection(app *pocketbase.PocketBase, hash string, version string, slr *core.Record, pt *protection) error {
+	output, err := filesystem.NewFileFromBytes([]byte(pt.output), "protected.lua")
+	if err != nil {
+		return err
+	}
+
+	body, err := filesystem.NewFileFromBytes([]byte(pt.body), "body.lua")
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]any{
+		"hash":                hash,
+		"preprocessorVersion": version,
+		"seal":                slr.Id,
+		"sealId":              pt.sealId,
+		"output":              output,
+		"body":                body,
+		"size":                len(pt.output),
+		"hits":                0,
+	}
+
+	cr, err := app.FindFirstRecordByFilter("protections", "hash = {:hash}", dbx.Params{"hash": hash})
+	if err != nil {
+		_, err = record.Create(app, "protections", fields)
+		return err
+	}
+
+	for key, value := range fields {
+		cr.Set(key, value)
+	}
+
+	return app.Save(cr)
+}
+
+// Seal a cached output again with a fresh key, so versions never share the key of their seal.
+// NB: The loader embeds a seal as it's id and the base64 of the sealed body, both are swapped in place.
+func reseal(pt *protection) (*protection, error) {
+	sealed := func(key []byte) (string, error) {
+		cr, err := rc4.NewCipher(key)
+		if err != nil {
+			return "", err
+		}
+
+		ct := make([]byte, len(pt.body))
+		cr.XORKeyStream(ct, []byte(pt.body))
+
+		return base64.StdEncoding.EncodeToString(ct), nil
+	}
+
+	old, err := sealed(pt.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Count(pt.output, old) != 1 {
+		return nil, errors.New("cached output doesn't embed it's sealed body")
+	}
+
+	sid, sk, err := newSeal()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := sealed(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	output := strings.Replace(pt.output, old, body, 1)
+
+	if strings.Count(output, pt.sealId) != 1 {
+		return nil, errors.New("cached output doesn't embed it's seal id")
+	}
+
+	output = strings.Replace(output, pt.sealId, sid, 1)
+
+	return &protection{sealId: sid, key: sk, output: output, body: pt.body}, nil
+}
+
+// Protect a script, reusing the cached output if nothing it depends on changed.
+// NB: Returns the hash the output is cached under and whether it came from the cache.
+// Cached outputs are sealed again with a fresh key, only the preprocessing is reused.
+func protectCached(app *pocketbase.PocketBase, loader string, source string, pr *core.Record, scriptId string) (*protection, string, string, bool, error) {
+	version, err := preprocessorVersion()
+	if err != nil {
+		return nil, "", "", false, err
+	}
+
+	hash := protectionHash(loader, source, pr, scriptId, version)
+
+	if cpt, ok := cachedProtection(app, hash); ok {
+		pt, err := reseal(cpt)
+		if err == nil {
+			return pt, hash, version, true, nil
+		}
+
+		app.Logger().Warn("failed to reseal cached protection", slog.String("hash", hash), slog.String("error", err.Error()))
+	}
+
+	pt, err := seal(loader, source, pr, scriptId)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+
+	return pt, hash, version, false, nil
+}
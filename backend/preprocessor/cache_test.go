@@ -0,0 +1,54 @@
+//go:build darwin || freebsd || linux || windows
+
+package preprocessor
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testSealed(t *testing.T, key []byte, body string) string {
+	t.Helper()
+
+	cr, err := rc4.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct := make([]byte, len(body))
+	cr.XORKeyStream(ct, []byte(body))
+
+	return base64.StdEncoding.EncodeToString(ct)
+}
+
+func TestReseal(t *testing.T) {
+	body := "print(\"hello\")\nreturn 42\n"
+	sid, sk, err := newSeal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := fmt.Sprintf("local SCRIPT_FUNCTIONS = {[\"script\"] = {\"%s\", \"%s\"}}\n", sid, testSealed(t, sk, body))
+
+	pt, err := reseal(&protection{sealId: sid, key: sk, output: output, body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pt.sealId == sid || bytes.Equal(pt.key, sk) {
+		t.Fatal("resealed protection kept the old seal")
+	}
+
+	want := fmt.Sprintf("local SCRIPT_FUNCTIONS = {[\"script\"] = {\"%s\", \"%s\"}}\n", pt.sealId, testSealed(t, pt.key, body))
+	if pt.output != want {
+		t.Fatalf("resealed output\n%s\nwant\n%s", pt.output, want)
+	}
+
+	if strings.Contains(pt.output, sid) {
+		t.Fatal("resealed output still embeds the old seal id")
+	}
+}
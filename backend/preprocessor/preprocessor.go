@@ -3,48 +3,72 @@
 package preprocessor
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"armorshield/bpool"
+	"armorshield/record"
 
-	"github.com/ebitengine/purego"
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
 )
 
 const EXPECTED_SCRIPT_FILE_SIZE int64 = 5243000
 
-// @todo: make it look prettier
-func Update(app *pocketbase.PocketBase, sr *core.Record) error {
-	if strings.Contains(sr.GetString("file"), "protected") {
-		return nil
+// A fresh upload replaced the script while it was being protected.
+var ErrSuperseded = errors.New("script was replaced while being protected")
+
+// Size of the keys scripts are sealed with.
+const SEAL_KEY_SIZE int = 16
+
+// Check if the script's file is a fresh upload that still has to be protected.
+func NeedsProtection(sr *core.Record) bool {
+	return len(sr.GetString("file")) > 0 && !strings.Contains(sr.GetString("file"), "protected")
+}
+
+// Path of the source to protect, the fresh upload or the source of the script's current version.
+func sourceKey(app *pocketbase.PocketBase, sr *core.Record) (string, error) {
+	if NeedsProtection(sr) {
+		return sr.BaseFilesPath() + "/" + sr.GetString("file"), nil
 	}
 
-	abs, err := filepath.Abs("../client/output/bundled.lua")
+	vr, err := app.FindRecordById("versions", sr.GetString("version"))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	out, err := os.ReadFile(abs)
+	return vr.BaseFilesPath() + "/" + vr.GetString("source"), nil
+}
+
+// Protect a script into a new version.
+// NB: Scripts that were already protected are protected again from the source of their current version.
+// @todo: make it look prettier
+func Update(app *pocketbase.PocketBase, sr *core.Record) error {
+	upload := sr.GetString("file")
+
+	abs, err := filepath.Abs("../client/output/bundled.lua")
 	if err != nil {
 		return err
 	}
 
-	lib, err := loadPreprocessor()
+	out, err := os.ReadFile(abs)
 	if err != nil {
 		return err
 	}
 
-	defer closeLibrary(lib)
-
-	var preprocess func(loader string, source string, salt string, point string, scriptId string) string
-	purego.RegisterLibFunc(&preprocess, lib, "preprocess")
-
 	if errs := app.ExpandRecord(sr, []string{"project"}, nil); len(errs) > 0 {
 		return errors.New("failed to expand record")
 	}
@@ -54,12 +78,23 @@ func Update(app *pocketbase.PocketBase, sr *core.Record) error {
 		return errors.New("failed to expand project")
 	}
 
-	key := sr.BaseFilesPath() + "/" + sr.GetString("file")
+	key, err := sourceKey(app, sr)
+	if err != nil {
+		return err
+	}
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return err
+	}
 
-	fsys, _ := app.NewFilesystem()
 	defer fsys.Close()
 
-	blob, _ := fsys.GetFile(key)
+	blob, err := fsys.GetFile(key)
+	if err != nil {
+		return err
+	}
+
 	defer blob.Close()
 
 	b := bpool.Get()
@@ -70,19 +105,248 @@ func Update(app *pocketbase.PocketBase, sr *core.Record) error {
 		return err
 	}
 
-	ps := preprocess(string(out), b.String(), pr.GetString("salt"), pr.GetString("point"), sr.Id)
-	if len(ps) == 0 {
-		return errors.New("failed to protect script")
+	blob.Close()
+
+	pt, hash, version, cached, err := protectCached(app, string(out), b.String(), pr, sr.Id)
+	if err != nil {
+		return err
 	}
 
-	blob.Close()
+	file, err := filesystem.NewFileFromBytes([]byte(pt.output), "protected.lua")
+	if err != nil {
+		return err
+	}
 
-	file, err := filesystem.NewFileFromBytes([]byte(ps), "protected.lua")
+	vr, err := createVersion(app, sr, b.Bytes(), pt)
 	if err != nil {
 		return err
 	}
 
-	sr.Set("file", file)
+	slr, err := createSeal(app, vr, pt.sealId, pt.key, []byte(pt.output))
+	if err != nil {
+		return err
+	}
+
+	if !cached {
+		if err := storeProtection(app, hash, version, slr, pt); err != nil {
+			app.Logger().Warn("failed to cache protection", slog.String("script", sr.Id), slog.String("error", err.Error()))
+		}
+	}
+
+	// NB: The script is read again, a fresh upload saved in the meantime must not be overwritten by this output.
+	return app.RunInTransaction(func(txApp core.App) error {
+		cur, err := txApp.FindRecordById("scripts", sr.Id)
+		if err != nil {
+			return err
+		}
+
+		if cur.GetString("file") != upload {
+			return ErrSuperseded
+		}
+
+		cur.Set("file", file)
+		cur.Set("version", vr.Id)
+		cur.Set("status", STATUS_PROTECTED)
+		cur.Set("error", "")
+		cur.Set("protectedAt", types.NowDateTime())
+
+		return txApp.Save(cur)
+	})
+}
+
+// A fresh seal id and key.
+func newSeal() (string, []byte, error) {
+	sk := make([]byte, SEAL_KEY_SIZE)
+	if _, err := rand.Read(sk); err != nil {
+		return "", nil, err
+	}
+
+	return security.RandomStringWithAlphabet(core.DefaultIdLength, core.DefaultIdAlphabet), sk, nil
+}
+
+// Protect a script's source into the loader, sealed with a fresh key that only lives on the server.
+func seal(loader string, source string, pr *core.Record, scriptId string) (*protection, error) {
+	sid, sk, err := newSeal()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), WORKER_TIMEOUT)
+	defer cancel()
+
+	res, err := runWorker(ctx, WorkerRequest{
+		Loader:   loader,
+		Source:   source,
+		Salt:     pr.GetString("salt"),
+		Point:    pr.GetString("point"),
+		ScriptId: scriptId,
+		SealId:   sid,
+		Key:      base64.StdEncoding.EncodeToString(sk),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &protection{sealId: sid, key: sk, output: res.Output, body: res.Body}, nil
+}
+
+// Keep the key of a seal and the protected output it belongs to.
+func createSeal(app *pocketbase.PocketBase, vr *core.Record, sid string, sk []byte, protected []byte) (*core.Record, error) {
+	pf, err := filesystem.NewFileFromBytes(protected, "protected.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Create(app, "seals", map[string]any{
+		"sealId":  sid,
+		"version": vr.Id,
+		"key":     base64.StdEncoding.EncodeToString(sk),
+		"file":    pf,
+		"revoked": false,
+	})
+}
+
+// Re-seal a version with a fresh key, optionally revoking every older seal of it.
+// NB: Loaders protected with a revoked seal can no longer unseal their script.
+func Rotate(app *pocketbase.PocketBase, vr *core.Record, revoke bool) (*core.Record, error) {
+	abs, err := filepath.Abs("../client/output/bundled.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.ReadFile(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	sr, err := app.FindRecordById("scripts", vr.GetString("script"))
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := app.FindRecordById("projects", sr.GetString("project"))
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	defer fsys.Close()
+
+	blob, err := fsys.GetFile(vr.BaseFilesPath() + "/" + vr.GetString("source"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer blob.Close()
+
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	if _, err := b.ReadFrom(io.LimitReader(blob, EXPECTED_SCRIPT_FILE_SIZE)); err != nil {
+		return nil, err
+	}
+
+	version, err := preprocessorVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	// NB: Rotations always seal with a fresh key, the cache only learns the new output.
+	pt, err := seal(string(out), b.String(), pr, sr.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoke {
+		olr, err := app.FindRecordsByFilter("seals", "version = {:versionId} && revoked != true", "", 0, 0, dbx.Params{"versionId": vr.Id})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, or := range olr {
+			or.Set("revoked", true)
+
+			if err := app.Save(or); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	slr, err := createSeal(app, vr, pt.sealId, pt.key, []byte(pt.output))
+	if err != nil {
+		return nil, err
+	}
+
+	hash := protectionHash(string(out), b.String(), pr, sr.Id, version)
+	if err := storeProtection(app, hash, version, slr, pt); err != nil {
+		app.Logger().Warn("failed to cache protection", slog.String("script", sr.Id), slog.String("error", err.Error()))
+	}
+
+	file, err := filesystem.NewFileFromBytes([]byte(pt.output), "protected.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	// The current version's script serves the newest seal.
+	// NB: The script is read again like in 'Update', a fresh upload or version saved in the meantime is left as it is.
+	err = app.RunInTransaction(func(txApp core.App) error {
+		cur, err := txApp.FindRecordById("scripts", sr.Id)
+		if err != nil {
+			return err
+		}
+
+		if cur.GetString("version") != vr.Id || cur.GetString("file") != sr.GetString("file") {
+			return nil
+		}
+
+		cur.Set("file", file)
+
+		return txApp.Save(cur)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return slr, nil
+}
+
+// Keep an immutable version of the source, preprocessed body and protected output of a script.
+func createVersion(app *pocketbase.PocketBase, sr *core.Record, source []byte, pt *protection) (*core.Record, error) {
+	count, err := app.CountRecords("versions", dbx.HashExp{"script": sr.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	sf, err := filesystem.NewFileFromBytes(source, "source.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	bf, err := filesystem.NewFileFromBytes([]byte(pt.body), "body.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	pf, err := filesystem.NewFileFromBytes([]byte(pt.output), "protected.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(source)
 
-	return app.Save(sr)
+	return record.Create(app, "versions", map[string]any{
+		"script":     sr.Id,
+		"number":     count + 1,
+		"sourceHash": hex.EncodeToString(hash[:]),
+		"source":     sf,
+		"body":       bf,
+		"file":       pf,
+		"author":     sr.GetString("author"),
+	})
 }
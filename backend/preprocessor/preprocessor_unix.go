@@ -4,12 +4,18 @@ package preprocessor
 
 import (
 	"path/filepath"
+	"syscall"
 
 	"github.com/ebitengine/purego"
 )
 
+// Path of the preprocessor library.
+func libraryPath() (string, error) {
+	return filepath.Abs("../preprocessor/target/release/libarmorshield_preprocessor.so")
+}
+
 func loadPreprocessor() (uintptr, error) {
-	abs, err := filepath.Abs("../preprocessor/target/release/libarmorshield_preprocessor.so")
+	abs, err := libraryPath()
 	if err != nil {
 		return uintptr(0x0), err
 	}
@@ -20,3 +26,8 @@ func loadPreprocessor() (uintptr, error) {
 func closeLibrary(handle uintptr) error {
 	return purego.Dlclose(handle)
 }
+
+// Limit the address space of this process.
+func limitMemory(limit uint64) error {
+	return syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit})
+}
@@ -5,8 +5,13 @@ import (
 	"syscall"
 )
 
+// Path of the preprocessor library.
+func libraryPath() (string, error) {
+	return filepath.Abs("../preprocessor/target/release/armorshield_preprocessor.dll")
+}
+
 func loadPreprocessor() (uintptr, error) {
-	abs, err := filepath.Abs("../preprocessor/target/release/armorshield_preprocessor.dll")
+	abs, err := libraryPath()
 	if err != nil {
 		return uintptr(0x0), err
 	}
@@ -18,3 +23,8 @@ func loadPreprocessor() (uintptr, error) {
 func closeLibrary(handle uintptr) error {
 	return syscall.FreeLibrary(syscall.Handle(handle))
 }
+
+// NB: Windows has no address space limits without job objects, workers still have their timeout.
+func limitMemory(limit uint64) error {
+	return nil
+}
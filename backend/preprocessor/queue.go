@@ -0,0 +1,215 @@
+//go:build darwin || freebsd || linux || windows
+
+package preprocessor
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Protection status of a script.
+const (
+	STATUS_PENDING    = "pending"
+	STATUS_PROCESSING = "processing"
+	STATUS_PROTECTED  = "protected"
+	STATUS_FAILED     = "failed"
+)
+
+// State of a script in the queue.
+const (
+	JOB_QUEUED = iota + 1
+	JOB_RUNNING
+
+	// Changed while being protected, so it's protected again right after.
+	JOB_DIRTY
+)
+
+// Amount of scripts protected at once.
+const DEFAULT_WORKERS int = 2
+
+// Amount of protection attempts before a script is marked as failed.
+const MAX_ATTEMPTS int = 3
+
+// Protects scripts in the background with a limited amount of workers.
+type Queue struct {
+	app     *pocketbase.PocketBase
+	workers int
+	jobs    chan string
+
+	// States of scripts that are queued or being protected and it's mutex.
+	mu     sync.Mutex
+	states map[string]int
+}
+
+func NewQueue(app *pocketbase.PocketBase, workers int) *Queue {
+	return &Queue{app: app, workers: max(workers, 1), jobs: make(chan string, 64), states: make(map[string]int)}
+}
+
+// Exponential backoff between attempts starting at 5 seconds.
+func backoff(attempts int) time.Duration {
+	return time.Duration(math.Pow(2, float64(attempts-1))) * 5 * time.Second
+}
+
+// Save the status of a script without running it's hooks, so status changes never queue it again.
+// NB: The script is read again, so a fresh upload saved in the meantime is never overwritten.
+func (q *Queue) status(id string, status string, reason string, attempts int) error {
+	sr, err := q.app.FindRecordById("scripts", id)
+	if err != nil {
+		return err
+	}
+
+	sr.Set("status", status)
+	sr.Set("error", reason)
+	sr.Set("attempts", attempts)
+
+	return q.app.UnsafeWithoutHooks().Save(sr)
+}
+
+// Queue a script for protection.
+// NB: Scripts that are already queued are ignored, scripts that are being protected are protected again once done.
+func (q *Queue) Enqueue(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch q.states[id] {
+	case JOB_QUEUED, JOB_DIRTY:
+		return
+	case JOB_RUNNING:
+		q.states[id] = JOB_DIRTY
+		return
+	}
+
+	q.states[id] = JOB_QUEUED
+
+	go func() { q.jobs <- id }()
+}
+
+// Check if a script changed while it was being protected.
+func (q *Queue) dirty(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.states[id] == JOB_DIRTY
+}
+
+// Queue a script for protection again from scratch, without re-uploading it.
+func (q *Queue) Rerun(sr *core.Record) error {
+	if err := q.status(sr.Id, STATUS_PENDING, "", 0); err != nil {
+		return err
+	}
+
+	q.Enqueue(sr.Id)
+
+	return nil
+}
+
+// Queue every script that was pending or interrupted while being protected.
+func (q *Queue) Requeue() error {
+	srl, err := q.app.FindRecordsByFilter(
+		"scripts",
+		"status = {:pending} || status = {:processing}",
+		"created", 0, 0,
+		dbx.Params{"pending": STATUS_PENDING, "processing": STATUS_PROCESSING},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	for _, sr := range srl {
+		q.Enqueue(sr.Id)
+	}
+
+	return nil
+}
+
+func (q *Queue) process(id string) {
+	q.mu.Lock()
+	q.states[id] = JOB_RUNNING
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if q.states[id] != JOB_DIRTY {
+			delete(q.states, id)
+			return
+		}
+
+		q.states[id] = JOB_QUEUED
+
+		go func() { q.jobs <- id }()
+	}()
+
+	sr, err := q.app.FindRecordById("scripts", id)
+	if err != nil {
+		return
+	}
+
+	attempts := sr.GetInt("attempts") + 1
+
+	if err := q.status(id, STATUS_PROCESSING, "", attempts); err != nil {
+		q.app.Logger().Error("failed to update script status", slog.String("script", id), slog.String("error", err.Error()))
+		return
+	}
+
+	err = Update(q.app, sr)
+	if err == nil {
+		return
+	}
+
+	// NB: A fresh upload replaced the script, it's protected again right after this.
+	if errors.Is(err, ErrSuperseded) || q.dirty(id) {
+		return
+	}
+
+	q.app.Logger().Warn("failed to protect script", slog.String("script", id), slog.Int("attempts", attempts), slog.String("error", err.Error()))
+
+	if attempts >= MAX_ATTEMPTS {
+		if err := q.status(id, STATUS_FAILED, err.Error(), attempts); err != nil {
+			q.app.Logger().Error("failed to update script status", slog.String("script", id), slog.String("error", err.Error()))
+		}
+
+		return
+	}
+
+	if err := q.status(id, STATUS_PENDING, err.Error(), attempts); err != nil {
+		q.app.Logger().Error("failed to update script status", slog.String("script", id), slog.String("error", err.Error()))
+		return
+	}
+
+	time.AfterFunc(backoff(attempts), func() { q.Enqueue(id) })
+}
+
+// NB: This function blocks until the context is done.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for range q.workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case id := <-q.jobs:
+					q.process(id)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
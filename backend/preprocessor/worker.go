@@ -0,0 +1,198 @@
+//go:build darwin || freebsd || linux || windows
+
+package preprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+)
+
+// Argument that makes the backend binary run as a preprocessor worker.
+const WORKER_COMMAND = "preprocess-worker"
+
+// Version of the request and response protocol between the backend and it's workers.
+// NB: Bump this whenever either side changes, a worker refuses requests of another version.
+const WORKER_PROTOCOL int = 2
+
+// How long a worker may take to protect a script before it's killed.
+const WORKER_TIMEOUT = 2 * time.Minute
+
+// Address space a worker may use before allocations start failing.
+const WORKER_MEMORY uint64 = 2 << 30
+
+// Amount of a worker's stderr kept for error reports.
+const WORKER_STDERR_LIMIT int = 4096
+
+type WorkerRequest struct {
+	Version  int    `json:"version"`
+	Loader   string `json:"loader"`
+	Source   string `json:"source"`
+	Salt     string `json:"salt"`
+	Point    string `json:"point"`
+	ScriptId string `json:"scriptId"`
+	SealId   string `json:"sealId"`
+	Key      string `json:"key"`
+}
+
+type WorkerResponse struct {
+	Version int    `json:"version"`
+	Output  string `json:"output"`
+	Body    string `json:"body"`
+	Error   string `json:"error"`
+}
+
+// Copy a string returned by the preprocessor library.
+func goString(p *byte) string {
+	if p == nil {
+		return ""
+	}
+
+	n := 0
+	for *(*byte)(unsafe.Add(unsafe.Pointer(p), n)) != 0 {
+		n++
+	}
+
+	return string(unsafe.Slice(p, n))
+}
+
+// Protect a script with the preprocessor library inside of this process.
+// NB: Returns the protected loader and the preprocessed body of the script for streaming.
+func protect(req *WorkerRequest) (string, string, error) {
+	lib, err := loadPreprocessor()
+	if err != nil {
+		return "", "", err
+	}
+
+	defer closeLibrary(lib)
+
+	var preprocess func(loader string, source string, salt string, point string, scriptId string, sealId string, key string) *byte
+	purego.RegisterLibFunc(&preprocess, lib, "preprocess")
+
+	var preprocessBody func(source string) *byte
+	purego.RegisterLibFunc(&preprocessBody, lib, "preprocess_body")
+
+	var free func(output *byte)
+	purego.RegisterLibFunc(&free, lib, "preprocess_free")
+
+	output := preprocess(req.Loader, req.Source, req.Salt, req.Point, req.ScriptId, req.SealId, req.Key)
+	if output == nil {
+		return "", "", errors.New("failed to protect script")
+	}
+
+	defer free(output)
+
+	body := preprocessBody(req.Source)
+	if body == nil {
+		return "", "", errors.New("failed to preprocess script body")
+	}
+
+	defer free(body)
+
+	return goString(output), goString(body), nil
+}
+
+// Serve a single request as a worker process and return it's exit code.
+// NB: Anything that goes wrong inside of the library kills only this process.
+func RunWorker(in io.Reader, out io.Writer) int {
+	res := WorkerResponse{Version: WORKER_PROTOCOL}
+
+	var req WorkerRequest
+	if err := json.NewDecoder(in).Decode(&req); err != nil {
+		res.Error = err.Error()
+	} else if req.Version != WORKER_PROTOCOL {
+		res.Error = fmt.Sprintf("unsupported protocol version %d", req.Version)
+	} else if err := limitMemory(WORKER_MEMORY); err != nil {
+		res.Error = err.Error()
+	} else if output, body, err := protect(&req); err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Output = output
+		res.Body = body
+	}
+
+	if err := json.NewEncoder(out).Encode(&res); err != nil {
+		return 1
+	}
+
+	if len(res.Error) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// Keeps the tail of whatever is written to it.
+type tailBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.buf.Write(p)
+
+	if over := tb.buf.Len() - tb.limit; over > 0 {
+		tb.buf.Next(over)
+	}
+
+	return len(p), nil
+}
+
+// Protect a script in a child worker process.
+// NB: Crashes, timeouts and out of memory kills of the worker are returned as errors.
+func runWorker(ctx context.Context, req WorkerRequest) (*WorkerResponse, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Version = WORKER_PROTOCOL
+
+	in, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	stderr := &tailBuffer{limit: WORKER_STDERR_LIMIT}
+
+	cmd := exec.CommandContext(ctx, exe, WORKER_COMMAND)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+
+	runErr := cmd.Run()
+
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("preprocessor worker timed out: %w", ctx.Err())
+	}
+
+	var res WorkerResponse
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("preprocessor worker crashed (%w): %s", runErr, strings.TrimSpace(stderr.buf.String()))
+		}
+
+		return nil, fmt.Errorf("malformed preprocessor worker response: %w", err)
+	}
+
+	if res.Version != WORKER_PROTOCOL {
+		return nil, fmt.Errorf("unsupported preprocessor worker protocol version %d", res.Version)
+	}
+
+	if len(res.Error) > 0 {
+		return nil, errors.New(res.Error)
+	}
+
+	return &res, nil
+}
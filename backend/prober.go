@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"reflect"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Amount of probes sent to a client.
+const PROBE_COUNT int = 4
+
+// What a probe inspects about a function.
+const (
+	// Name of the function through 'debug.info'.
+	PROBE_KIND_NAME byte = iota
+
+	// Amount of upvalues of the function.
+	PROBE_KIND_UPVALUES
+
+	// If the function is a C closure.
+	PROBE_KIND_CCLOSURE
+
+	// Sorted "key:type" shape of the table returned by 'debug.getinfo'.
+	PROBE_KIND_GETINFO
+
+	// Source, line and arity of the function through 'debug.info'.
+	PROBE_KIND_INFO
+)
+
+type prober struct {
+	id     identifier
+	sbid   string
+	probes []*core.Record
+}
+
+// Pick random probes from the catalog that apply to the project and exploit.
+func pickProbes(sub *subscription, bs *bootstrapper) ([]*core.Record, error) {
+	if bs.pm.Exempt(EXEMPT_INTEGRITY) {
+		return []*core.Record{}, nil
+	}
+
+	prl, err := sub.app.FindRecordsByFilter(
+		"probes",
+		"project = '' || project = {:projectId}",
+		"", 0, 0, dbx.Params{"projectId": bs.pr.Id},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	probes := []*core.Record{}
+
+	for _, pr := range prl {
+		if ex := pr.GetString("exploit"); len(ex) > 0 && !strings.Contains(strings.ToLower(bs.en), strings.ToLower(ex)) {
+			continue
+		}
+
+		probes = append(probes, pr)
+	}
+
+	rand.Shuffle(len(probes), func(i, j int) {
+		probes[i], probes[j] = probes[j], probes[i]
+	})
+
+	if len(probes) > PROBE_COUNT {
+		probes = probes[:PROBE_COUNT]
+	}
+
+	return probes, nil
+}
+
+// Round-trip a value through JSON so numbers from msgpack and from the database compare equally.
+func normalize(val any) any {
+	ba, err := json.Marshal(val)
+	if err != nil {
+		return nil
+	}
+
+	var out any
+	if err := json.Unmarshal(ba, &out); err != nil {
+		return nil
+	}
+
+	return out
+}
+
+// Check if a probe result matches the expected profile.
+func matchProbe(kind byte, expected string, fcd *FunctionCheckData) bool {
+	var ev any
+	if err := json.Unmarshal([]byte(expected), &ev); err != nil {
+		return false
+	}
+
+	switch kind {
+	case PROBE_KIND_NAME:
+		return reflect.DeepEqual(ev, normalize(fcd.String))
+	case PROBE_KIND_UPVALUES:
+		return reflect.DeepEqual(ev, normalize(fcd.Byte))
+	case PROBE_KIND_CCLOSURE:
+		return reflect.DeepEqual(ev, normalize(fcd.Boolean))
+	case PROBE_KIND_GETINFO:
+		return reflect.DeepEqual(ev, normalize(fcd.StringArray))
+	case PROBE_KIND_INFO:
+		em, ok := ev.(map[string]any)
+		if !ok {
+			return false
+		}
+
+		// NB: Only the expected fields are compared.
+		im, _ := normalize(fcd.Info).(map[string]any)
+		for key, val := range em {
+			if !reflect.DeepEqual(val, im[key]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Send the probes to the client.
+func (pb prober) challenge(sub *subscription) error {
+	fps := []FunctionProbe{}
+
+	for _, pr := range pb.probes {
+		fps = append(fps, FunctionProbe{
+			Id:       pr.Id,
+			Function: pr.GetString("function"),
+			Kind:     byte(pr.GetInt("kind")),
+		})
+	}
+
+	return pb.id.hs.message(sub, Message{Id: PacketIdFunctionCheck, Data: FunctionCheckRequest{
+		Probes: fps,
+	}})
+}
+
+func (pb prober) handle(sub *subscription, pk Packet) error {
+	var fr FunctionCheckResponse
+	err := pb.id.hs.unmarshal(sub, pk.Msg, &fr)
+	if err != nil {
+		return err
+	}
+
+	bs := sub.bootstrapper
+	mismatches := []string{}
+
+	results := make(map[string]FunctionCheckData)
+	for _, res := range fr.Results {
+		results[res.Id] = res.Data
+	}
+
+	for _, pr := range pb.probes {
+		fcd, ok := results[pr.Id]
+		if ok && matchProbe(byte(pr.GetInt("kind")), pr.GetString("expected"), &fcd) {
+			continue
+		}
+
+		mismatches = append(mismatches, pr.GetString("function"))
+	}
+
+	if len(mismatches) > 0 {
+		sub.logger.Warn("function integrity mismatch", slog.Any("functions", mismatches))
+	}
+
+	jd := newJudge(sub.app, bs, pb.sbid)
+	jd.judge(RULE_INTEGRITY, checkIntegrity(mismatches))
+
+	if err := jd.record(sub); err != nil {
+		sub.logger.Error("failed to record verdicts", slog.String("error", err.Error()))
+	}
+
+	// NB: Canaries are never told they were caught.
+	if !bs.kr.Canary() {
+		if enforced, err := jd.enforce(sub); enforced {
+			return err
+		}
+	}
+
+	sub.state.AddFlag(STATE_CHECKED)
+	sub.handler = loader{id: pb.id}
+
+	return nil
+}
+
+func (pb prober) packet() byte {
+	return PacketIdFunctionCheck
+}
+
+func (pb prober) state(sub *subscription) bool {
+	return sub.state.HasFlag(STATE_IDENTIFIED) && !sub.state.HasFlag(STATE_CHECKED)
+}
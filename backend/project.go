@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"time"
 
 	"github.com/pocketbase/pocketbase/core"
 )
@@ -12,6 +13,162 @@ type Project struct {
 	core.BaseRecordProxy
 }
 
+// Default amount of seconds a frame must stall for the client to report a freeze.
+const DEFAULT_FREEZE_THRESHOLD float64 = 5.0
+
+// Default time the client has to answer an attestation challenge.
+const DEFAULT_ATTEST_DEADLINE time.Duration = 15 * time.Second
+
+// Default length of a ban for a failed attestation.
+const DEFAULT_ATTEST_BAN time.Duration = 24 * time.Hour
+
+// Default window freezes of a key are counted in.
+const DEFAULT_FREEZE_WINDOW time.Duration = 24 * time.Hour
+
+// Default length of a ban for a key that froze too often.
+const DEFAULT_FREEZE_BAN time.Duration = 24 * time.Hour
+
+// Default share of a bolo workspace a session must match to be flagged.
+const DEFAULT_WORKSPACE_THRESHOLD float64 = 0.33
+
+// Possible escalations for a misbehaving subscription.
+const (
+	ESCALATE_NONE = ""
+	ESCALATE_BOLO = "bolo"
+	ESCALATE_DROP = "drop"
+	ESCALATE_BAN  = "ban"
+)
+
+// What happens to keys linked to a newly blacklisted or bolo key.
+const (
+	CASCADE_INCIDENT = "incident"
+	CASCADE_BAN      = "ban"
+	CASCADE_NONE     = "none"
+)
+
+// How streamed scripts are watermarked.
+const (
+	WATERMARK_OFF     = ""
+	WATERMARK_KEY     = "key"
+	WATERMARK_SESSION = "session"
+)
+
+// Default length of a ban cascaded to a linked key.
+const DEFAULT_CASCADE_BAN time.Duration = 24 * time.Hour
+
+// How a project escalates client freezes.
+type FreezePolicy struct {
+	// Seconds a frame must stall for before the client reports it.
+	Threshold float64
+
+	// Amount of freezes of a key within the window before escalating.
+	// NB: Zero disables this limit.
+	Limit int
+
+	// How far back freezes of a key are counted, across reconnects.
+	Window time.Duration
+
+	// Length of a single freeze in seconds before escalating.
+	// NB: Zero disables this limit.
+	Seconds float64
+
+	// What to do when escalating.
+	Action string
+
+	// How long a temporary ban lasts.
+	BanDuration time.Duration
+}
+
+// How a project attests loaded subscriptions.
+type AttestPolicy struct {
+	// Average time between challenges.
+	// NB: Zero disables attestation.
+	Interval time.Duration
+
+	// Time the client has to answer a challenge.
+	Deadline time.Duration
+
+	// What to do when a challenge is missed or wrong.
+	Action string
+
+	// How long a temporary ban lasts.
+	BanDuration time.Duration
+}
+
+// How a project treats keys linked to a newly blacklisted or bolo key.
+type CascadePolicy struct {
+	// What to do with a linked key.
+	Action string
+
+	// How long a cascaded ban lasts.
+	BanDuration time.Duration
+}
+
+func (pr *Project) AttestPolicy() AttestPolicy {
+	ap := AttestPolicy{
+		Interval:    time.Duration(pr.GetFloat("attestInterval") * float64(time.Second)),
+		Deadline:    time.Duration(pr.GetFloat("attestDeadline") * float64(time.Second)),
+		Action:      pr.GetString("attestAction"),
+		BanDuration: time.Duration(pr.GetFloat("attestBanHours") * float64(time.Hour)),
+	}
+
+	if ap.Deadline <= 0 {
+		ap.Deadline = DEFAULT_ATTEST_DEADLINE
+	}
+
+	if ap.Action == ESCALATE_NONE {
+		ap.Action = ESCALATE_DROP
+	}
+
+	if ap.BanDuration <= 0 {
+		ap.BanDuration = DEFAULT_ATTEST_BAN
+	}
+
+	return ap
+}
+
+func (pr *Project) FreezePolicy() FreezePolicy {
+	fp := FreezePolicy{
+		Threshold:   pr.GetFloat("freezeThreshold"),
+		Limit:       pr.GetInt("freezeLimit"),
+		Window:      time.Duration(pr.GetFloat("freezeWindowHours") * float64(time.Hour)),
+		Seconds:     pr.GetFloat("freezeSeconds"),
+		Action:      pr.GetString("freezeAction"),
+		BanDuration: time.Duration(pr.GetFloat("freezeBanHours") * float64(time.Hour)),
+	}
+
+	if fp.Threshold <= 0 {
+		fp.Threshold = DEFAULT_FREEZE_THRESHOLD
+	}
+
+	if fp.Window <= 0 {
+		fp.Window = DEFAULT_FREEZE_WINDOW
+	}
+
+	if fp.BanDuration <= 0 {
+		fp.BanDuration = DEFAULT_FREEZE_BAN
+	}
+
+	return fp
+}
+
+func (pr *Project) CascadePolicy() CascadePolicy {
+	cp := CascadePolicy{
+		Action:      pr.GetString("cascadeAction"),
+		BanDuration: time.Duration(pr.GetFloat("cascadeBanHours") * float64(time.Hour)),
+	}
+
+	if len(cp.Action) <= 0 {
+		cp.Action = CASCADE_INCIDENT
+	}
+
+	if cp.BanDuration <= 0 {
+		cp.BanDuration = DEFAULT_CASCADE_BAN
+	}
+
+	return cp
+}
+
 func (pr *Project) Point() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(pr.GetString("point"))
 }
@@ -19,3 +176,17 @@ func (pr *Project) Point() ([]byte, error) {
 func (pr *Project) Salt() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(pr.GetString("salt"))
 }
+
+// Share of a bolo workspace a session must match to be flagged.
+func (pr *Project) WorkspaceThreshold() float64 {
+	if wt := pr.GetFloat("workspaceThreshold"); wt > 0 {
+		return wt
+	}
+
+	return DEFAULT_WORKSPACE_THRESHOLD
+}
+
+// How streamed scripts of the project are watermarked.
+func (pr *Project) WatermarkMode() string {
+	return pr.GetString("watermark")
+}
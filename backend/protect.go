@@ -0,0 +1,42 @@
+package main
+
+import (
+	"armorshield/preprocessor"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Mark freshly uploaded scripts as pending protection before they're saved.
+func pendProtection(e *core.RecordEvent) error {
+	if preprocessor.NeedsProtection(e.Record) {
+		e.Record.Set("status", preprocessor.STATUS_PENDING)
+		e.Record.Set("error", "")
+		e.Record.Set("attempts", 0)
+	}
+
+	return e.Next()
+}
+
+// Register the endpoint that protects a script again without re-uploading it.
+// NB: Scripts that were already protected are protected from the source of their current version.
+func bindProtect(app *pocketbase.PocketBase, pq *preprocessor.Queue, se *core.ServeEvent) {
+	se.Router.POST("/scripts/{id}/protect", func(e *core.RequestEvent) error {
+		sr, err := app.FindRecordById("scripts", e.Request.PathValue("id"))
+		if err != nil {
+			return apis.NewNotFoundError("script not found", err)
+		}
+
+		if sr.GetString("status") == preprocessor.STATUS_PROCESSING {
+			return apis.NewBadRequestError("script is already being protected", nil)
+		}
+
+		if err := pq.Rerun(sr); err != nil {
+			return err
+		}
+
+		return e.JSON(http.StatusAccepted, map[string]any{"script": sr.Id, "status": preprocessor.STATUS_PENDING})
+	}).Bind(apis.RequireSuperuserAuth())
+}
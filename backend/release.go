@@ -0,0 +1,188 @@
+package main
+
+import (
+	"armorshield/bpool"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/http"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+// Release channels of scripts.
+const (
+	CHANNEL_STABLE   = "stable"
+	CHANNEL_BETA     = "beta"
+	CHANNEL_INTERNAL = "internal"
+)
+
+// Bucket of a key for staged rollouts, stable across builds so the same keys go first.
+func rolloutBucket(kid string) float64 {
+	h := sha256.Sum256([]byte(kid))
+	return float64(binary.BigEndian.Uint64(h[:8]) % 100)
+}
+
+// Check if the key falls within the rollout percentage of a build.
+// NB: Builds without a rollout percentage are rolled out to everyone.
+func inRollout(kr *Key, sr *core.Record) bool {
+	rollout := sr.GetFloat("rollout")
+	if rollout <= 0 || rollout >= 100 {
+		return true
+	}
+
+	return rolloutBucket(kr.Id) < rollout
+}
+
+// The channel a key is assigned to, by the key itself or by it's role.
+func keyChannel(kr *Key, pm *Permissions) string {
+	if channel := kr.GetString("channel"); len(channel) > 0 {
+		return channel
+	}
+
+	if len(pm.Channel) > 0 {
+		return pm.Channel
+	}
+
+	return CHANNEL_STABLE
+}
+
+// Pick the newest build for the target in the key's channel that is rolled out to the key.
+// NB: Keys fall back to the stable channel if their channel has no build for the target.
+func pickScript(app *pocketbase.PocketBase, pr *Project, kr *Key, pm *Permissions, tg target) (*core.Record, error) {
+	channels := []string{keyChannel(kr, pm)}
+	if channels[0] != CHANNEL_STABLE {
+		channels = append(channels, CHANNEL_STABLE)
+	}
+
+	for _, channel := range channels {
+		filter := "project = {:projectId} && rolledBack != true && channel = {:channel}"
+		if channel == CHANNEL_STABLE {
+			filter = "project = {:projectId} && rolledBack != true && (channel = '' || channel = {:channel})"
+		}
+
+		params := dbx.Params{"projectId": pr.Id, "channel": channel}
+		for key, value := range tg.params {
+			params[key] = value
+		}
+
+		srl, err := app.FindRecordsByFilter(
+			"scripts",
+			filter+" && ("+tg.filter+")",
+			"-created", 0, 0, params,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sr := range srl {
+			if inRollout(kr, sr) {
+				return sr, nil
+			}
+		}
+	}
+
+	return nil, errors.New("no script for target")
+}
+
+// Point a script back at the version before it's current one, serving the newest active seal of it.
+// NB: Returns nil if the script has no earlier version to go back to.
+func restoreVersion(app *pocketbase.PocketBase, sr *core.Record) (*core.Record, error) {
+	cur, err := app.FindRecordById("versions", sr.GetString("version"))
+	if err != nil {
+		return nil, nil
+	}
+
+	vrl, err := app.FindRecordsByFilter(
+		"versions",
+		"script = {:scriptId} && number < {:number}",
+		"-number", 1, 0, dbx.Params{"scriptId": sr.Id, "number": cur.GetInt("number")},
+	)
+
+	if err != nil || len(vrl) <= 0 {
+		return nil, err
+	}
+
+	vr := vrl[0]
+	key := vr.BaseFilesPath() + "/" + vr.GetString("file")
+
+	// Rotations leave the version's own output with an older seal, the newest active one is served instead.
+	slr, err := app.FindRecordsByFilter(
+		"seals",
+		"version = {:versionId} && revoked != true",
+		"-created", 1, 0, dbx.Params{"versionId": vr.Id},
+	)
+
+	if err == nil && len(slr) > 0 {
+		key = slr[0].BaseFilesPath() + "/" + slr[0].GetString("file")
+	}
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	defer fsys.Close()
+
+	blob, err := fsys.GetFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer blob.Close()
+
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	if _, err := b.ReadFrom(blob); err != nil {
+		return nil, err
+	}
+
+	file, err := filesystem.NewFileFromBytes(b.Bytes(), "protected.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	sr.Set("file", file)
+	sr.Set("version", vr.Id)
+
+	if err := app.Save(sr); err != nil {
+		return nil, err
+	}
+
+	return vr, nil
+}
+
+// Register the rollback endpoint for superusers.
+// NB: Rolling back a build restores it's previous version, builds without one are taken offline
+// so the loader picks the previous build of it's channel again.
+func bindRollback(app *pocketbase.PocketBase, se *core.ServeEvent) {
+	se.Router.POST("/scripts/{id}/rollback", func(e *core.RequestEvent) error {
+		sr, err := app.FindRecordById("scripts", e.Request.PathValue("id"))
+		if err != nil {
+			return apis.NewNotFoundError("script not found", err)
+		}
+
+		vr, err := restoreVersion(app, sr)
+		if err != nil {
+			return err
+		}
+
+		if vr != nil {
+			return e.JSON(http.StatusOK, map[string]any{"rolledBack": sr.Id, "version": vr.Id})
+		}
+
+		sr.Set("rolledBack", true)
+
+		if err := app.Save(sr); err != nil {
+			return err
+		}
+
+		return e.JSON(http.StatusOK, map[string]any{"rolledBack": sr.Id})
+	}).Bind(apis.RequireSuperuserAuth())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Read the protected output a script currently serves.
+func testScriptFile(t *testing.T, app *pocketbase.PocketBase, sr *core.Record) string {
+	t.Helper()
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fsys.Close()
+
+	blob, err := fsys.GetFile(sr.BaseFilesPath() + "/" + sr.GetString("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestRollbackRestoresVersion(t *testing.T) {
+	app := newTestApp(t)
+
+	testCollection(t, app, "scripts",
+		&core.FileField{Name: "file", MaxSelect: 1},
+		&core.TextField{Name: "version"},
+		&core.BoolField{Name: "rolledBack"},
+	)
+	testCollection(t, app, "versions",
+		&core.TextField{Name: "script"},
+		&core.NumberField{Name: "number"},
+		&core.FileField{Name: "file", MaxSelect: 1},
+	)
+	testCollection(t, app, "seals",
+		&core.TextField{Name: "version"},
+		&core.FileField{Name: "file", MaxSelect: 1},
+		&core.BoolField{Name: "revoked"},
+	)
+
+	sr := testRecord(t, app, "scripts", map[string]any{})
+
+	first := testRecord(t, app, "versions", map[string]any{"script": sr.Id, "number": 1, "file": testFile(t, "first")})
+	testRecord(t, app, "seals", map[string]any{"version": first.Id, "file": testFile(t, "first rotated")})
+	second := testRecord(t, app, "versions", map[string]any{"script": sr.Id, "number": 2, "file": testFile(t, "second")})
+
+	sr.Set("version", second.Id)
+	sr.Set("file", testFile(t, "second"))
+
+	if err := app.Save(sr); err != nil {
+		t.Fatal(err)
+	}
+
+	vr, err := restoreVersion(app, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vr == nil || vr.Id != first.Id {
+		t.Fatalf("restored %v, want version %s", vr, first.Id)
+	}
+
+	sr, err = app.FindRecordById("scripts", sr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sr.GetString("version") != first.Id || sr.GetBool("rolledBack") {
+		t.Fatalf("script points at %s (rolled back %t), want %s", sr.GetString("version"), sr.GetBool("rolledBack"), first.Id)
+	}
+
+	if data := testScriptFile(t, app, sr); data != "first rotated" {
+		t.Fatalf("script serves %q, want the newest seal of the first version", data)
+	}
+
+	// The first version has nothing before it.
+	if vr, err := restoreVersion(app, sr); vr != nil || err != nil {
+		t.Fatalf("restored %v (%v) without an earlier version", vr, err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Ways a key can be linked to another key in historical records.
+const (
+	LINK_HWID    = "hwid"
+	LINK_IP      = "ip"
+	LINK_SESSION = "session"
+)
+
+// Check if a key update should trigger a re-scan of it's linked keys.
+func rescanNeeded(kr *core.Record) bool {
+	orig := kr.Original()
+
+	if len(kr.GetString("blacklist")) > 0 && len(orig.GetString("blacklist")) <= 0 {
+		return true
+	}
+
+	return kr.GetBool("bolo") && !orig.GetBool("bolo")
+}
+
+// Find keys that share a HWID, IP or Roblox session with the key, along with how they're linked.
+func linkedKeys(app *pocketbase.PocketBase, kr *Key) (map[string][]string, error) {
+	links := map[string][]string{}
+
+	add := func(kid string, link string) {
+		if len(kid) <= 0 || kid == kr.Id || slices.Contains(links[kid], link) {
+			return
+		}
+
+		links[kid] = append(links[kid], link)
+	}
+
+	frl, err := app.FindRecordsByFilter("fingerprints", "key = {:keyId}", "", 0, 0, dbx.Params{"keyId": kr.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fr := range frl {
+		if hwid := fr.GetString("exploitHwid"); len(hwid) > 0 {
+			lfrl, err := app.FindRecordsByFilter(
+				"fingerprints",
+				"key != {:keyId} && exploitHwid = {:exploitHwid}",
+				"", 0, 0, dbx.Params{"keyId": kr.Id, "exploitHwid": hwid},
+			)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, lfr := range lfrl {
+				add(lfr.GetString("key"), LINK_HWID)
+			}
+		}
+
+		if ip := fr.GetString("ipAddress"); len(ip) > 0 {
+			lfrl, err := app.FindRecordsByFilter(
+				"fingerprints",
+				"key != {:keyId} && ipAddress = {:ipAddress}",
+				"", 0, 0, dbx.Params{"keyId": kr.Id, "ipAddress": ip},
+			)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, lfr := range lfrl {
+				add(lfr.GetString("key"), LINK_IP)
+			}
+		}
+	}
+
+	srl, err := app.FindRecordsByFilter("sessions", "subscription.key = {:keyId}", "", 0, 0, dbx.Params{"keyId": kr.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sr := range srl {
+		rsid := sr.GetString("robloxSessionId")
+		psid := sr.GetString("playSessionId")
+
+		if len(rsid) <= 0 && len(psid) <= 0 {
+			continue
+		}
+
+		lsrl, err := app.FindRecordsByFilter(
+			"sessions",
+			"subscription.key != {:keyId} && ((robloxSessionId != '' && robloxSessionId = {:robloxSessionId}) || (playSessionId != '' && playSessionId = {:playSessionId}))",
+			"", 0, 0, dbx.Params{"keyId": kr.Id, "robloxSessionId": rsid, "playSessionId": psid},
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if errs := app.ExpandRecords(lsrl, []string{"subscription"}, nil); len(errs) > 0 {
+			continue
+		}
+
+		for _, lsr := range lsrl {
+			if sbr := lsr.ExpandedOne("subscription"); sbr != nil {
+				add(sbr.GetString("key"), LINK_SESSION)
+			}
+		}
+	}
+
+	return links, nil
+}
+
+// Find keys linked to a newly blacklisted or bolo key and apply the policy of their project.
+func rescan(app *pocketbase.PocketBase, sv *server, kr *Key) error {
+	links, err := linkedKeys(app, kr)
+	if err != nil {
+		return err
+	}
+
+	action := ACTION_BOLO
+	if kr.Blacklisted() {
+		action = ACTION_BLACKLIST
+	}
+
+	for kid, via := range links {
+		lk, err := FindKeyById(app, kid)
+		if err != nil {
+			continue
+		}
+
+		// NB: Keys that are already dealt with are left alone.
+		if lk.Blacklisted() || lk.Banned(time.Now()) {
+			continue
+		}
+
+		pr, err := lk.Project(app)
+		if err != nil {
+			continue
+		}
+
+		reason := fmt.Sprintf("linked to key %s (%v)", kr.Id, via)
+
+		cp := pr.CascadePolicy()
+
+		switch cp.Action {
+		case CASCADE_BAN:
+			until, err := types.ParseDateTime(time.Now().Add(cp.BanDuration))
+			if err != nil {
+				return err
+			}
+
+			lk.Set("bannedUntil", until)
+
+			// NB: Saving the key closes it's live subscriptions through the key update hook.
+			if err := app.Save(lk); err != nil {
+				return err
+			}
+		case CASCADE_INCIDENT:
+			if _, err := openLinkedIncident(app, lk, pr, kr, action, via); err != nil {
+				return err
+			}
+		}
+
+		// NB: Banned keys are closed by the key update hook, keys under review are rejected here.
+		for _, sub := range sv.findByKey(lk) {
+			sub.dispatch(func() error {
+				bs := sub.bootstrapper
+
+				if err := bs.alert(sub, action, reason); err != nil {
+					sub.logger.Error("failed to queue alert", slog.String("error", err.Error()))
+				}
+
+				if cp.Action != CASCADE_INCIDENT {
+					return nil
+				}
+
+				return bs.reject(sub, reason, "your key is under review")
+			})
+		}
+	}
+
+	app.Logger().Info("re-scanned linked keys", slog.String("key", kr.Id), slog.Int("linked", len(links)))
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// A filter over scripts that a load request can resolve to.
+type target struct {
+	filter string
+	params dbx.Params
+}
+
+// Targets of a load request, from the most to the least specific.
+// NB: PlaceId overrides win over the game, which wins over it's game groups, which win over universal scripts.
+func targets(app *pocketbase.PocketBase, pr *Project, lr *LoadRequest) []target {
+	tgs := []target{}
+
+	if lr.PlaceId > 0 {
+		tgs = append(tgs, target{filter: "place = {:placeId}", params: dbx.Params{"placeId": lr.PlaceId}})
+	}
+
+	tgs = append(tgs, target{filter: "game = {:gameId} && place = 0", params: dbx.Params{"gameId": lr.GameId}})
+
+	ggrl, err := app.FindRecordsByFilter(
+		"gameGroups",
+		"project = {:projectId}",
+		"", 0, 0, dbx.Params{"projectId": pr.Id},
+	)
+
+	if err == nil {
+		for _, ggr := range ggrl {
+			var games []uint64
+			if err := ggr.UnmarshalJSONField("games", &games); err != nil || !slices.Contains(games, lr.GameId) {
+				continue
+			}
+
+			tgs = append(tgs, target{filter: "gameGroup = {:gameGroupId}", params: dbx.Params{"gameGroupId": ggr.Id}})
+		}
+	}
+
+	return append(tgs, target{filter: "universal = true", params: dbx.Params{}})
+}
+
+// Resolve the script for a load request through every target in order.
+func resolveScript(app *pocketbase.PocketBase, pr *Project, kr *Key, pm *Permissions, tgs []target) (*core.Record, error) {
+	for _, tg := range tgs {
+		sr, err := pickScript(app, pr, kr, pm, tg)
+		if err == nil {
+			return sr, nil
+		}
+	}
+
+	return nil, errors.New("no script for your current game")
+}
+
+// Check if a script applies to any of the targets.
+func matchesTargets(app *pocketbase.PocketBase, sr *core.Record, tgs []target) bool {
+	for _, tg := range tgs {
+		params := dbx.Params{"scriptId": sr.Id}
+		for key, value := range tg.params {
+			params[key] = value
+		}
+
+		if mr, err := app.FindFirstRecordByFilter("scripts", "id = {:scriptId} && ("+tg.filter+")", params); err == nil && mr != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Ordered modules to load for a script, it's libraries first and the script itself last.
+// NB: Libraries that fail a check are still listed with their current version, alongside the first error.
+func scriptModules(app *pocketbase.PocketBase, pr *Project, kr *Key, pm *Permissions, sr *core.Record, vid string) ([]LoadModule, error) {
+	modules := []LoadModule{}
+
+	var failed error
+
+	if errs := app.ExpandRecord(sr, []string{"modules"}, nil); len(errs) <= 0 {
+		for _, mr := range sr.ExpandedAll("modules") {
+			if mr.Id == sr.Id {
+				continue
+			}
+
+			mvid, err := pickModule(app, pr, kr, pm, mr)
+			if err != nil && failed == nil {
+				failed = err
+			}
+
+			modules = append(modules, LoadModule{ScriptId: mr.Id, VersionId: mvid})
+		}
+	}
+
+	return append(modules, LoadModule{ScriptId: sr.Id, VersionId: vid}), failed
+}
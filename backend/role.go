@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Exemption that skips the function integrity checks.
+const EXEMPT_INTEGRITY = "integrity"
+
+// What a key is allowed to do, resolved from it's role.
+// NB: Empty lists and zero limits allow everything.
+type Permissions struct {
+	// Game ids the key may load in.
+	Games []uint64
+
+	// Script channels the key may load.
+	Channels []string
+
+	// Script channel the key is assigned to.
+	Channel string
+
+	// Script version the key is pinned to.
+	Version string
+
+	// Subscriptions the key may have at once.
+	Sessions int
+
+	// Distinct devices the key may use.
+	Devices int
+
+	// Rules and checks that are never enforced against the key.
+	Exemptions []string
+}
+
+// Roles that have permissions even if the project doesn't define them.
+var builtinRoles = map[string]Permissions{
+	"pentest": {Games: []uint64{BASEPLATE_GAME_ID}},
+}
+
+func permissionsFromRecord(rr *core.Record) Permissions {
+	pm := Permissions{
+		Channels:   rr.GetStringSlice("channels"),
+		Channel:    rr.GetString("channel"),
+		Version:    rr.GetString("version"),
+		Sessions:   rr.GetInt("sessions"),
+		Devices:    rr.GetInt("devices"),
+		Exemptions: rr.GetStringSlice("exemptions"),
+	}
+
+	// NB: Game ids are stored as a json array of numbers.
+	rr.UnmarshalJSONField("games", &pm.Games)
+
+	return pm
+}
+
+// Resolve the permissions of the key's role in it's project.
+func resolveRole(app *pocketbase.PocketBase, kr *Key, pr *Project) Permissions {
+	role := kr.GetString("role")
+	if len(role) <= 0 {
+		return Permissions{}
+	}
+
+	rr, err := app.FindFirstRecordByFilter(
+		"roles",
+		"project = {:projectId} && name = {:name}",
+		dbx.Params{"projectId": pr.Id, "name": role},
+	)
+
+	if err == nil {
+		return permissionsFromRecord(rr)
+	}
+
+	return builtinRoles[role]
+}
+
+// Push the freshly resolved permissions of the key to it's subscription.
+// NB: This function must run on the read loop of the subscription.
+func pushPermissions(sub *subscription, kr *Key) error {
+	bs := *sub.bootstrapper
+	bs.kr = kr
+	bs.pm = resolveRole(sub.app, kr, bs.pr)
+
+	sub.server.bootstrap(sub, &bs)
+
+	if !sub.state.HasFlag(STATE_LOADED) {
+		return nil
+	}
+
+	return sub.handshaker.message(sub, Message{
+		Id:   PacketIdKeyUpdate,
+		Data: KeyUpdatePacket{Role: kr.GetString("role"), Permissions: bs.pm},
+	})
+}
+
+func (pm *Permissions) AllowsGame(gid uint64) bool {
+	return len(pm.Games) <= 0 || slices.Contains(pm.Games, gid)
+}
+
+func (pm *Permissions) AllowsChannel(channel string) bool {
+	if len(channel) <= 0 {
+		channel = CHANNEL_STABLE
+	}
+
+	return len(pm.Channels) <= 0 || slices.Contains(pm.Channels, channel)
+}
+
+func (pm *Permissions) Exempt(check string) bool {
+	return slices.Contains(pm.Exemptions, check)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"armorshield/record"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Detection rules that a project can configure.
+const (
+	RULE_BLACKLIST   = "blacklist"
+	RULE_DEVICE      = "device"
+	RULE_MISMATCH    = "mismatch"
+	RULE_ASSOSIATION = "assosiation"
+	RULE_NETWORK     = "network"
+	RULE_GEO         = "geo"
+	RULE_TRAVEL      = "travel"
+	RULE_VERSION     = "version"
+	RULE_INTEGRITY   = "integrity"
+)
+
+// How a rule is evaluated.
+const (
+	RULE_LIVE   = "live"
+	RULE_SHADOW = "shadow"
+	RULE_OFF    = "off"
+)
+
+// What a triggered rule does to the subscription.
+const (
+	VERDICT_LOG       = "log"
+	VERDICT_CLOSE     = "close"
+	VERDICT_BAN       = "ban"
+	VERDICT_BLACKLIST = "blacklist"
+)
+
+// How long a ban from a rule lasts if the project doesn't specify it.
+const DEFAULT_RULE_BAN time.Duration = 24 * time.Hour
+
+// Built-in behaviour of a rule.
+type ruleSpec struct {
+	action  string
+	reason  string
+	message string
+}
+
+// NB: Fuzzy matches like the device rule only log by default, a project has to opt into acting on them.
+var ruleSpecs = map[string]ruleSpec{
+	RULE_BLACKLIST:   {action: VERDICT_BLACKLIST, reason: "linked key with blacklist"},
+	RULE_DEVICE:      {action: VERDICT_LOG, reason: "device closely matches a blacklisted key"},
+	RULE_MISMATCH:    {action: VERDICT_CLOSE, reason: "fingerprint mismatch", message: "reset your HWID on the panel"},
+	RULE_ASSOSIATION: {action: VERDICT_LOG, reason: "key is associated to marked users"},
+	RULE_NETWORK:     {action: VERDICT_LOG, reason: "key is connecting from a hosted network"},
+	RULE_GEO:         {action: VERDICT_LOG, reason: "key analytics are implausible for it's location"},
+	RULE_TRAVEL:      {action: VERDICT_LOG, reason: "key traveled impossibly far since it's last session"},
+	RULE_VERSION:     {action: VERDICT_BLACKLIST, reason: "invalid lua version"},
+	RULE_INTEGRITY:   {action: VERDICT_CLOSE, reason: "integrity check failed"},
+}
+
+// How a project evaluates a rule.
+type RulePolicy struct {
+	Mode        string
+	Action      string
+	BanDuration time.Duration
+}
+
+// Rule policies of a project.
+// NB: Rules without a policy are live with their built-in action.
+func rulePolicies(app *pocketbase.PocketBase, pr *Project) map[string]RulePolicy {
+	policies := map[string]RulePolicy{}
+
+	for name, spec := range ruleSpecs {
+		policies[name] = RulePolicy{Mode: RULE_LIVE, Action: spec.action, BanDuration: DEFAULT_RULE_BAN}
+	}
+
+	rrl, err := app.FindRecordsByFilter(
+		"rules",
+		"project = {:projectId}",
+		"", 0, 0, dbx.Params{"projectId": pr.Id},
+	)
+
+	if err != nil {
+		return policies
+	}
+
+	for _, rr := range rrl {
+		rp, ok := policies[rr.GetString("rule")]
+		if !ok {
+			continue
+		}
+
+		if mode := rr.GetString("mode"); len(mode) > 0 {
+			rp.Mode = mode
+		}
+
+		if action := rr.GetString("action"); len(action) > 0 {
+			rp.Action = action
+		}
+
+		if hours := rr.GetFloat("banHours"); hours > 0 {
+			rp.BanDuration = time.Duration(hours * float64(time.Hour))
+		}
+
+		policies[rr.GetString("rule")] = rp
+	}
+
+	return policies
+}
+
+// The outcome of a triggered rule.
+type Verdict struct {
+	Rule    string
+	Mode    string
+	Action  string
+	Results []ResultType
+	Reason  string
+	policy  RulePolicy
+}
+
+// Evaluates rules of a subscription, records their verdicts and enforces the live ones.
+type judge struct {
+	bs       *bootstrapper
+	sbid     string
+	policies map[string]RulePolicy
+	verdicts []Verdict
+}
+
+func newJudge(app *pocketbase.PocketBase, bs *bootstrapper, sbid string) *judge {
+	return &judge{bs: bs, sbid: sbid, policies: rulePolicies(app, bs.pr)}
+}
+
+// Add the verdict of a rule if any of it's results failed.
+func (jd *judge) judge(rule string, results ...ResultType) {
+	failed := []ResultType{}
+
+	for _, rt := range results {
+		if rt != RESULT_SUCCESS {
+			failed = append(failed, rt)
+		}
+	}
+
+	rp := jd.policies[rule]
+	if len(failed) <= 0 || rp.Mode == RULE_OFF || jd.bs.pm.Exempt(rule) {
+		return
+	}
+
+	jd.verdicts = append(jd.verdicts, Verdict{
+		Rule:    rule,
+		Mode:    rp.Mode,
+		Action:  rp.Action,
+		Results: failed,
+		Reason:  fmt.Sprintf("%s (%d)", ruleSpecs[rule].reason, failed[0]),
+		policy:  rp,
+	})
+}
+
+// Persist every verdict, live or not.
+func (jd *judge) record(sub *subscription) error {
+	for _, vd := range jd.verdicts {
+		_, err := record.Create(sub.app, "verdicts", map[string]any{
+			"project":      jd.bs.pr.Id,
+			"key":          jd.bs.kr.Id,
+			"subscription": jd.sbid,
+			"rule":         vd.Rule,
+			"mode":         vd.Mode,
+			"action":       vd.Action,
+			"results":      vd.Results,
+			"reason":       vd.Reason,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enforce live verdicts in order, stopping at the first one that ends the subscription.
+// NB: This function might close the connection.
+func (jd *judge) enforce(sub *subscription) (bool, error) {
+	bs := jd.bs
+
+	for _, vd := range jd.verdicts {
+		if vd.Mode != RULE_LIVE {
+			sub.logger.Info("shadow rule triggered", slog.String("rule", vd.Rule), slog.String("action", vd.Action), slog.Any("types", vd.Results))
+			continue
+		}
+
+		switch vd.Action {
+		case VERDICT_LOG:
+			sub.logger.Warn(ruleSpecs[vd.Rule].reason, slog.String("rule", vd.Rule), slog.Any("types", vd.Results))
+		case VERDICT_CLOSE:
+			if err := bs.alert(sub, ACTION_MISMATCH, vd.Reason); err != nil {
+				sub.logger.Error("failed to queue alert", slog.String("error", err.Error()))
+			}
+
+			message := ruleSpecs[vd.Rule].message
+			if len(message) <= 0 {
+				message = ruleSpecs[vd.Rule].reason
+			}
+
+			return true, bs.reject(sub, vd.Reason, fmt.Sprintf("%s (%d)", message, vd.Results[0]))
+		case VERDICT_BAN:
+			return true, bs.escalate(sub, ESCALATE_BAN, vd.policy.BanDuration, vd.Reason)
+		case VERDICT_BLACKLIST:
+			return true, bs.blacklist(sub, vd.Reason)
+		}
+	}
+
+	return false, nil
+}
+
+// Amount of subscriptions a rule acted on, or would have acted on, per mode and action.
+type RuleReport struct {
+	Rule    string         `json:"rule"`
+	Mode    string         `json:"mode"`
+	Actions map[string]int `json:"actions"`
+	seen    map[string]map[string]bool
+}
+
+// Report verdicts of a project's rules over a period.
+func reportRules(app *pocketbase.PocketBase, projectId string, since time.Time, until time.Time) ([]*RuleReport, error) {
+	from, err := types.ParseDateTime(since)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := types.ParseDateTime(until)
+	if err != nil {
+		return nil, err
+	}
+
+	vrl, err := app.FindRecordsByFilter(
+		"verdicts",
+		"project = {:projectId} && created >= {:since} && created <= {:until}",
+		"", 0, 0, dbx.Params{"projectId": projectId, "since": from, "until": to},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []*RuleReport{}
+	index := map[string]*RuleReport{}
+
+	for _, vr := range vrl {
+		id := vr.GetString("rule") + "\x00" + vr.GetString("mode")
+
+		rp, ok := index[id]
+		if !ok {
+			rp = &RuleReport{
+				Rule:    vr.GetString("rule"),
+				Mode:    vr.GetString("mode"),
+				Actions: map[string]int{},
+				seen:    map[string]map[string]bool{},
+			}
+
+			index[id] = rp
+			reports = append(reports, rp)
+		}
+
+		action := vr.GetString("action")
+		if rp.seen[action] == nil {
+			rp.seen[action] = map[string]bool{}
+		}
+
+		// NB: Count subscriptions, not verdicts.
+		if sbid := vr.GetString("subscription"); !rp.seen[action][sbid] {
+			rp.seen[action][sbid] = true
+			rp.Actions[action] += 1
+		}
+	}
+
+	return reports, nil
+}
+
+// Register the rule report endpoint for superusers.
+func bindRuleReport(app *pocketbase.PocketBase, se *core.ServeEvent) {
+	se.Router.GET("/rules/report", func(e *core.RequestEvent) error {
+		query := e.Request.URL.Query()
+
+		until := time.Now()
+		since := until.Add(-7 * 24 * time.Hour)
+
+		if value := query.Get("since"); len(value) > 0 {
+			dt, err := types.ParseDateTime(value)
+			if err != nil {
+				return apis.NewBadRequestError("invalid since date", err)
+			}
+
+			since = dt.Time()
+		}
+
+		if value := query.Get("until"); len(value) > 0 {
+			dt, err := types.ParseDateTime(value)
+			if err != nil {
+				return apis.NewBadRequestError("invalid until date", err)
+			}
+
+			until = dt.Time()
+		}
+
+		reports, err := reportRules(app, query.Get("project"), since, until)
+		if err != nil {
+			return err
+		}
+
+		return e.JSON(http.StatusOK, reports)
+	}).Bind(apis.RequireSuperuserAuth())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"armorshield/preprocessor"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Unseal keys of every active seal of the modules' versions, by seal id.
+// NB: Only ever sent in the load response, after identify and every check passed.
+// Streamed modules never run from the loader, so their keys are held back.
+func unsealKeys(app *pocketbase.PocketBase, modules []LoadModule) map[string][preprocessor.SEAL_KEY_SIZE]byte {
+	keys := map[string][preprocessor.SEAL_KEY_SIZE]byte{}
+
+	for _, lm := range modules {
+		if len(lm.VersionId) <= 0 || lm.Streamed {
+			continue
+		}
+
+		slr, err := app.FindRecordsByFilter(
+			"seals",
+			"version = {:versionId} && revoked != true",
+			"", 0, 0, dbx.Params{"versionId": lm.VersionId},
+		)
+
+		if err != nil {
+			continue
+		}
+
+		for _, sl := range slr {
+			sk, err := base64.StdEncoding.DecodeString(sl.GetString("key"))
+			if err != nil || len(sk) != preprocessor.SEAL_KEY_SIZE {
+				continue
+			}
+
+			keys[sl.GetString("sealId")] = [preprocessor.SEAL_KEY_SIZE]byte(sk)
+		}
+	}
+
+	return keys
+}
+
+// Register the seal rotation endpoint for superusers.
+// NB: With revoke set, loaders protected with the older seals of the version stop working.
+func bindSealRotate(app *pocketbase.PocketBase, se *core.ServeEvent) {
+	se.Router.POST("/versions/{id}/rotate", func(e *core.RequestEvent) error {
+		vr, err := app.FindRecordById("versions", e.Request.PathValue("id"))
+		if err != nil {
+			return apis.NewNotFoundError("version not found", err)
+		}
+
+		slr, err := preprocessor.Rotate(app, vr, e.Request.URL.Query().Get("revoke") == "true")
+		if err != nil {
+			return apis.NewBadRequestError("failed to rotate seal", err)
+		}
+
+		return e.JSON(http.StatusOK, map[string]any{"version": vr.Id, "seal": slr.GetString("sealId")})
+	}).Bind(apis.RequireSuperuserAuth())
+}
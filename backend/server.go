@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"path/filepath"
 	"sync"
 
+	"armorshield/ipintel"
+
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/shamaton/msgpack/v2"
@@ -24,6 +27,9 @@ type server struct {
 	// Pocketbase app.
 	app *pocketbase.PocketBase
 
+	// Offline IP intelligence.
+	intel *ipintel.Database
+
 	// List of subscriptions and it's mutex.
 	sm   sync.Mutex
 	subs map[*subscription]struct{}
@@ -31,10 +37,11 @@ type server struct {
 
 func newServer(app *pocketbase.PocketBase) *server {
 	return &server{
-		pkcl: 8,
-		rdl:  32768,
-		subs: make(map[*subscription]struct{}),
-		app:  app,
+		pkcl:  8,
+		rdl:   32768,
+		subs:  make(map[*subscription]struct{}),
+		app:   app,
+		intel: ipintel.New(filepath.Join(app.DataDir(), "ipintel")),
 	}
 }
 
@@ -93,6 +100,8 @@ func (sv *server) subscribe(e *core.RequestEvent) error {
 
 	group, ctx := errgroup.WithContext(context.Background())
 
+	sub.ctx = ctx
+
 	group.Go(func() error {
 		return sub.read(ctx, conn)
 	})
@@ -112,22 +121,66 @@ func (sv *server) subscribe(e *core.RequestEvent) error {
 	return err
 }
 
-func (sv *server) find(kr *Key) *subscription {
+// Swap the bootstrapper of a subscription.
+// NB: Handlers read the bootstrapper of their subscription, so this is enforced from the next packet on.
+func (sv *server) bootstrap(sub *subscription, bs *bootstrapper) {
+	sv.sm.Lock()
+	defer sv.sm.Unlock()
+
+	sub.bootstrapper = bs
+}
+
+// Count the bootstrapped subscriptions of a key.
+func (sv *server) count(kr *Key) int {
 	sv.sm.Lock()
 	defer sv.sm.Unlock()
 
+	count := 0
+
+	for sub := range sv.subs {
+		if bs := sub.bootstrapper; bs != nil && bs.kr.Id == kr.Id {
+			count += 1
+		}
+	}
+
+	return count
+}
+
+// Find the bootstrapped subscriptions of keys with a role in a project.
+func (sv *server) findByRole(projectId string, role string) []*subscription {
+	sv.sm.Lock()
+	defer sv.sm.Unlock()
+
+	subs := []*subscription{}
+
 	for sub := range sv.subs {
 		bs := sub.bootstrapper
-		if bs == nil {
+		if bs == nil || bs.pr.Id != projectId || bs.kr.GetString("role") != role {
 			continue
 		}
 
-		if bs.kr.Id != kr.Id {
+		subs = append(subs, sub)
+	}
+
+	return subs
+}
+
+// Find every bootstrapped subscription of a key.
+// NB: Roles can allow a key more than one session at once.
+func (sv *server) findByKey(kr *Key) []*subscription {
+	sv.sm.Lock()
+	defer sv.sm.Unlock()
+
+	subs := []*subscription{}
+
+	for sub := range sv.subs {
+		bs := sub.bootstrapper
+		if bs == nil || bs.kr.Id != kr.Id {
 			continue
 		}
 
-		return sub
+		subs = append(subs, sub)
 	}
 
-	return nil
+	return subs
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"armorshield/bpool"
+	"armorshield/preprocessor"
+	"armorshield/watermark"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pocketbase/pocketbase"
+)
+
+// Size of a single streamed chunk.
+const CHUNK_SIZE int = 16384
+
+// Maximum amount of chunks sent for a single request, kept below the packet channel limit.
+// NB: Clients download modules one after another, so a single window is in flight per subscription.
+const CHUNK_WINDOW uint32 = 4
+
+// Streams the payloads of loaded modules in chunks over the encrypted channel.
+// NB: Only modules the subscription was authorized to load are ever added.
+type streamer struct {
+	hs handshaker
+
+	// Mark embedded into every payload.
+	// NB: Only valid if 'marked' is set.
+	mark   uint64
+	marked bool
+
+	// Payloads by script id and it's mutex.
+	mu       sync.Mutex
+	payloads map[string][]byte
+}
+
+func newStreamer(hs handshaker) *streamer {
+	return &streamer{hs: hs, payloads: make(map[string][]byte)}
+}
+
+// Read the preprocessed body of a version from storage.
+// NB: Never the uploaded source, that still holds everything the preprocessor strips.
+func versionPayload(app *pocketbase.PocketBase, vid string) ([]byte, error) {
+	vr, err := app.FindRecordById("versions", vid)
+	if err != nil {
+		return nil, err
+	}
+
+	body := vr.GetString("body")
+	if len(body) <= 0 {
+		return nil, errors.New("version has no preprocessed body")
+	}
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	defer fsys.Close()
+
+	blob, err := fsys.GetFile(vr.BaseFilesPath() + "/" + body)
+	if err != nil {
+		return nil, err
+	}
+
+	defer blob.Close()
+
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	if _, err := b.ReadFrom(io.LimitReader(blob, preprocessor.EXPECTED_SCRIPT_FILE_SIZE)); err != nil {
+		return nil, err
+	}
+
+	// NB: The buffer goes back to the pool, so copy it out.
+	return append([]byte{}, b.Bytes()...), nil
+}
+
+// Prepare a module for streaming and describe it's payload.
+// NB: Modules without a stored version aren't streamed and are loaded from the bundled scripts instead.
+func (st *streamer) add(app *pocketbase.PocketBase, lm *LoadModule) error {
+	if len(lm.VersionId) <= 0 {
+		return nil
+	}
+
+	payload, err := versionPayload(app, lm.VersionId)
+	if err != nil {
+		return err
+	}
+
+	if st.marked {
+		payload = watermark.Embed(payload, st.mark)
+	}
+
+	st.mu.Lock()
+	st.payloads[lm.ScriptId] = payload
+	st.mu.Unlock()
+
+	lm.Streamed = true
+	lm.Size = uint64(len(payload))
+	lm.Chunks = uint32((len(payload) + CHUNK_SIZE - 1) / CHUNK_SIZE)
+	lm.Digest = sha256.Sum256(payload)
+
+	return nil
+}
+
+// Send a window of chunks of a module starting at an index.
+func (st *streamer) send(sub *subscription, sid string, index uint32, count uint32) error {
+	st.mu.Lock()
+	payload, ok := st.payloads[sid]
+	st.mu.Unlock()
+
+	if !ok {
+		return errors.New("chunk request for unknown module")
+	}
+
+	total := uint32((len(payload) + CHUNK_SIZE - 1) / CHUNK_SIZE)
+	end := min(index+min(count, CHUNK_WINDOW), total)
+
+	for idx := index; idx < end; idx++ {
+		start := int(idx) * CHUNK_SIZE
+		data := payload[start:min(start+CHUNK_SIZE, len(payload))]
+
+		err := st.hs.message(sub, Message{Id: PacketIdChunk, Data: ChunkPacket{
+			ScriptId: sid,
+			Index:    idx,
+			Total:    total,
+			Data:     string(data),
+			Digest:   sha256.Sum256(data),
+		}})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (st *streamer) handle(sub *subscription, pk Packet) error {
+	var cr ChunkRequest
+	err := st.hs.unmarshal(sub, pk.Msg, &cr)
+	if err != nil {
+		return err
+	}
+
+	return st.send(sub, cr.ScriptId, cr.Index, cr.Count)
+}
+
+func (st *streamer) packet() byte {
+	return PacketIdChunk
+}
+
+func (st *streamer) state(sub *subscription) bool {
+	return sub.state.HasFlag(STATE_LOADED)
+}
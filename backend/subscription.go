@@ -4,11 +4,13 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"time"
 
 	"armorshield/bpool"
+	"armorshield/ipintel"
 
 	"github.com/google/uuid"
 	"github.com/pocketbase/pocketbase"
@@ -23,21 +25,30 @@ const (
 	STATE_HANDSHAKED
 	STATE_IDENTIFIED
 	STATE_LOADED
+	STATE_CHECKED
 )
 
 // A subscription represents a connection to the server.
 // NB: Pointer to handlers are not initialized yet!
 type subscription struct {
 	app          *pocketbase.PocketBase
+	server       *server
+	intel        *ipintel.Database
 	logger       *slog.Logger
 	bootstrapper *bootstrapper
 	handshaker   *handshaker
 	freezer      *freezer
+	attester     *attester
+	streamer     *streamer
+	ctx          context.Context
+	script       string
 	uuid         uuid.UUID
 	timestamp    time.Time
 	state        Bitmask
 	ip           string
 	packets      chan Packet
+	events       chan func() error
+	done         chan struct{}
 	handler      handler
 	closing      bool
 	close        func(reason string) error
@@ -55,16 +66,21 @@ func newSubscription(sv *server, ip string) *subscription {
 
 	return &subscription{
 		app:       app,
+		server:    sv,
+		intel:     sv.intel,
 		logger:    slogger.With(slog.String("uuid", uuid.String()), slog.String("ip", ip)),
 		timestamp: time.Now(),
 		ip:        ip,
 		packets:   make(chan Packet, sv.pkcl),
+		events:    make(chan func() error, sv.pkcl),
+		done:      make(chan struct{}),
 		handler:   bootstrapper{},
 		uuid:      uuid,
 	}
 }
 
-func (sub *subscription) read(ctx context.Context, conn *websocket.Conn) error {
+// Read and decode packets from the connection until it fails.
+func (sub *subscription) receive(ctx context.Context, conn *websocket.Conn, packets chan<- Packet) error {
 	for {
 		_, rr, err := conn.Reader(ctx)
 
@@ -77,15 +93,17 @@ func (sub *subscription) read(ctx context.Context, conn *websocket.Conn) error {
 		}
 
 		bp := bpool.Get()
-		defer bpool.Put(bp)
 
 		_, err = bp.ReadFrom(rr)
 		if err != nil {
+			bpool.Put(bp)
 			return err
 		}
 
-		ba := bp.Bytes()
-		ds, err := hex.DecodeString(string(ba))
+		ba := bp.String()
+		bpool.Put(bp)
+
+		ds, err := hex.DecodeString(ba)
 
 		if err != nil {
 			return err
@@ -98,35 +116,81 @@ func (sub *subscription) read(ctx context.Context, conn *websocket.Conn) error {
 			return err
 		}
 
-		sub.logger.Info("handling packet", slog.String("data", string(ba)), slog.Int("id", int(pk.Id)))
-
-		hr := sub.handler
+		sub.logger.Info("handling packet", slog.String("data", ba), slog.Int("id", int(pk.Id)))
 
-		if hr == nil {
-			return errors.New("handler is nil")
+		select {
+		case packets <- pk:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
+}
 
-		if sub.freezer != nil && sub.freezer.state(sub) && sub.freezer.packet() == pk.Id {
-			// Handle packet.
-			if err := sub.freezer.handle(sub, pk); err != nil {
-				return err
-			}
+// Handle packets and events of the subscription.
+// NB: This is the only goroutine that changes the state of the subscription.
+func (sub *subscription) read(ctx context.Context, conn *websocket.Conn) error {
+	defer close(sub.done)
 
-			// Continue to the next packet.
-			continue
-		}
+	packets := make(chan Packet)
+	failed := make(chan error, 1)
 
-		if hr.packet() != pk.Id || !hr.state(sub) {
-			return errors.New("handler is not in the correct state")
-		}
+	go func() {
+		failed <- sub.receive(ctx, conn, packets)
+	}()
 
-		err = hr.handle(sub, pk)
-		if err != nil {
+	for {
+		select {
+		case pk := <-packets:
+			if err := sub.handle(pk); err != nil {
+				return err
+			}
+		case fn := <-sub.events:
+			if err := fn(); err != nil {
+				return err
+			}
+		case err := <-failed:
 			return err
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
+// Run a function on the read loop of the subscription.
+// NB: Anything outside of the read loop that changes the subscription must go through here.
+func (sub *subscription) dispatch(fn func() error) {
+	select {
+	case sub.events <- fn:
+	case <-sub.done:
+	}
+}
+
+func (sub *subscription) handle(pk Packet) error {
+	hr := sub.handler
+
+	if hr == nil {
+		return errors.New("handler is nil")
+	}
+
+	if sub.freezer != nil && sub.freezer.state(sub) && sub.freezer.packet() == pk.Id {
+		return sub.freezer.handle(sub, pk)
+	}
+
+	if sub.attester != nil && sub.attester.state(sub) && sub.attester.packet() == pk.Id {
+		return sub.attester.handle(sub, pk)
+	}
+
+	if sub.streamer != nil && sub.streamer.state(sub) && sub.streamer.packet() == pk.Id {
+		return sub.streamer.handle(sub, pk)
+	}
+
+	if hr.packet() != pk.Id || !hr.state(sub) {
+		return errors.New("handler is not in the correct state")
+	}
+
+	return hr.handle(sub, pk)
+}
+
 func (sub *subscription) communicate(ctx context.Context, conn *websocket.Conn, pk Packet) error {
 	ser, err := msgpack.Marshal(pk)
 	if err != nil {
@@ -160,13 +224,28 @@ func (sub *subscription) packet(pk Packet) error {
 	return nil
 }
 
+// What of a message's data is logged.
+// NB: Script chunks and unseal keys must never end up in the subscription logs.
+func redact(data any) any {
+	switch dt := data.(type) {
+	case ChunkPacket:
+		dt.Data = fmt.Sprintf("(%d bytes)", len(dt.Data))
+		return dt
+	case LoadResponse:
+		dt.UnsealKeys = nil
+		return dt
+	}
+
+	return data
+}
+
 func (sub *subscription) message(msg Message) error {
 	ser, err := msgpack.Marshal(msg.Data)
 	if err != nil {
 		return err
 	}
 
-	sub.logger.Info("sending message", slog.Int("id", int(msg.Id)), slog.Any("data", msg.Data))
+	sub.logger.Info("sending message", slog.Int("id", int(msg.Id)), slog.Any("data", redact(msg.Data)))
 
 	return sub.packet(Packet{Id: msg.Id, Msg: ser})
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"armorshield/record"
+	"armorshield/watermark"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+// A watermark that might have produced a leaked file.
+type TraceResult struct {
+	KeyId        string `json:"keyId"`
+	Subscription string `json:"subscription"`
+	ScriptId     string `json:"scriptId"`
+	VersionId    string `json:"versionId"`
+	Distance     int    `json:"distance"`
+
+	// Distance to the string marker of the leaked file.
+	// NB: Only set if the file has a marker.
+	MarkerDistance int `json:"markerDistance"`
+}
+
+// The mark of a subscription's streamed scripts, derived from it's key and in session mode it's subscription.
+// NB: Returns false if the project doesn't watermark.
+func watermarkFor(sub *subscription, kr *Key, pr *Project) (uint64, bool) {
+	mode := pr.WatermarkMode()
+	if mode != WATERMARK_KEY && mode != WATERMARK_SESSION {
+		return 0, false
+	}
+
+	salt, err := pr.Salt()
+	if err != nil {
+		return 0, false
+	}
+
+	if mode == WATERMARK_SESSION {
+		return watermark.Derive(salt, kr.Id, sub.uuid.String()), true
+	}
+
+	return watermark.Derive(salt, kr.Id), true
+}
+
+// Record which key and subscription a watermarked module was served to.
+// NB: In key mode the mark never changes, so it's only recorded once per version.
+func recordWatermark(sub *subscription, kr *Key, pr *Project, lm *LoadModule, mark uint64) error {
+	session := pr.WatermarkMode() == WATERMARK_SESSION
+
+	if !session {
+		count, err := sub.app.CountRecords("watermarks", dbx.HashExp{"key": kr.Id, "version": lm.VersionId})
+		if err != nil || count > 0 {
+			return err
+		}
+	}
+
+	subscription := ""
+	if session {
+		subscription = sub.uuid.String()
+	}
+
+	_, err := record.Create(sub.app, "watermarks", map[string]any{
+		"key":          kr.Id,
+		"subscription": subscription,
+		"script":       lm.ScriptId,
+		"version":      lm.VersionId,
+		"mark":         fmt.Sprintf("%016x", mark),
+	})
+
+	return err
+}
+
+// Rank every recorded watermark by how close it's mark is to the one of a leaked file.
+// NB: The numeric literals are trusted over the string marker, which is trivial to swap for the mark of someone else.
+func trace(app *pocketbase.PocketBase, source []byte, limit int) ([]TraceResult, watermark.Result, error) {
+	res := watermark.Extract(source)
+	if res.Covered <= 0 && !res.Marked {
+		return nil, res, errors.New("no watermark found")
+	}
+
+	// NB: Without any literals only the marker is left to compare against.
+	distance := res.Distance
+	if res.Covered <= 0 {
+		distance = func(wm uint64) int {
+			return watermark.Distance(res.Marker, wm)
+		}
+	}
+
+	wrl, err := app.FindAllRecords("watermarks")
+	if err != nil {
+		return nil, res, err
+	}
+
+	results := []TraceResult{}
+
+	for _, wr := range wrl {
+		wm, err := strconv.ParseUint(wr.GetString("mark"), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		tr := TraceResult{
+			KeyId:        wr.GetString("key"),
+			Subscription: wr.GetString("subscription"),
+			ScriptId:     wr.GetString("script"),
+			VersionId:    wr.GetString("version"),
+			Distance:     distance(wm),
+		}
+
+		if res.Marked {
+			tr.MarkerDistance = watermark.Distance(res.Marker, wm)
+		}
+
+		results = append(results, tr)
+	}
+
+	slices.SortStableFunc(results, func(a, b TraceResult) int {
+		return a.Distance - b.Distance
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, res, nil
+}
+
+// Command that reports the keys and subscriptions a leaked file most likely came from.
+func traceCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var limit int
+
+	cmd := &cobra.Command{
+		Use:   "trace <file>",
+		Short: "Trace a leaked script back to the key and subscription it was served to",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			source, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			results, res, err := trace(app, source, limit)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "mark %016x from %d literals covering %d/%d bits, marker %t\n", res.Mark, res.Literals, res.Covered, watermark.MARK_BITS, res.Marked)
+
+			if res.Disagrees() {
+				fmt.Fprintf(cmd.OutOrStdout(), "marker %016x disagrees with the literals by %d bits, it was likely edited\n", res.Marker, watermark.Distance(res.Marker, res.Mark))
+			}
+
+			for _, tr := range results {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\t%s\t%s\t%d\t%d\n", tr.KeyId, tr.Subscription, tr.ScriptId, tr.VersionId, tr.Distance, tr.MarkerDistance)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&limit, "limit", 5, "maximum amount of candidates to report")
+
+	return cmd
+}
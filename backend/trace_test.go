@@ -0,0 +1,52 @@
+package main
+
+import (
+	"armorshield/watermark"
+	"fmt"
+	"math/bits"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestTracePartialCoverage(t *testing.T) {
+	const leaked uint64 = 0xA5C3_0F96_1E2D_7B48
+
+	var b strings.Builder
+	for idx := range 6 {
+		fmt.Fprintf(&b, "local value%d = { %d, %d }\n", idx, idx, idx*7+1)
+	}
+
+	src := watermark.Embed([]byte(b.String()), leaked)
+
+	res := watermark.Extract(src)
+	if res.Covered <= 0 || res.Covered >= watermark.MARK_BITS-8 {
+		t.Fatalf("source should only cover part of the mark, covered %d", res.Covered)
+	}
+
+	// A mark matching the literals in all but one covered bit, and zero in every bit they don't cover.
+	low := bits.TrailingZeros64(res.Mask)
+	decoy := (leaked & res.Mask) ^ (1 << low)
+
+	app := newTestApp(t)
+	testCollection(t, app, "watermarks",
+		&core.TextField{Name: "key"},
+		&core.TextField{Name: "subscription"},
+		&core.TextField{Name: "script"},
+		&core.TextField{Name: "version"},
+		&core.TextField{Name: "mark"},
+	)
+
+	testRecord(t, app, "watermarks", map[string]any{"key": "decoy", "mark": fmt.Sprintf("%016x", decoy)})
+	testRecord(t, app, "watermarks", map[string]any{"key": "leaked", "mark": fmt.Sprintf("%016x", leaked)})
+
+	results, _, err := trace(app, src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].KeyId != "leaked" || results[0].Distance != 0 {
+		t.Fatalf("leaked key wasn't ranked first: %+v", results)
+	}
+}
@@ -1,5 +1,12 @@
 package universe
 
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
 type Universe map[uint64]bool
 
 func New(ui []uint64) Universe {
@@ -25,3 +32,44 @@ func (u Universe) SliceMatches(ui []uint64) []uint64 {
 
 	return usm
 }
+
+// Pack a set of ids into a compact string by delta encoding the sorted ids as varints.
+func Pack(ui []uint64) string {
+	ids := slices.Clone(ui)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	ba := []byte{}
+	prev := uint64(0)
+
+	for _, i := range ids {
+		ba = binary.AppendUvarint(ba, i-prev)
+		prev = i
+	}
+
+	return base64.RawStdEncoding.EncodeToString(ba)
+}
+
+// Unpack a set of ids from a string created by Pack.
+func Unpack(s string) ([]uint64, error) {
+	ba, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	ui := []uint64{}
+	prev := uint64(0)
+
+	for len(ba) > 0 {
+		delta, n := binary.Uvarint(ba)
+		if n <= 0 {
+			return nil, errors.New("malformed packed universe")
+		}
+
+		prev += delta
+		ui = append(ui, prev)
+		ba = ba[n:]
+	}
+
+	return ui, nil
+}
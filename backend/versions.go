@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Metadata of a version that is compared when diffing.
+// NB: Timestamps always differ, so they're reported next to the changes instead.
+var versionFields = []string{"script", "number", "sourceHash", "author", "file", "source"}
+
+// The version a key is pinned to, by the key itself or by it's role.
+func pinnedVersion(kr *Key, pm *Permissions) string {
+	if vid := kr.GetString("pinnedVersion"); len(vid) > 0 {
+		return vid
+	}
+
+	return pm.Version
+}
+
+// Pick the script and version the key should load for the load request.
+// NB: Pins to a version of another project or a script that doesn't apply to the request are ignored.
+func pickVersion(app *pocketbase.PocketBase, pr *Project, kr *Key, pm *Permissions, lr *LoadRequest) (*core.Record, string, error) {
+	tgs := targets(app, pr, lr)
+
+	if vid := pinnedVersion(kr, pm); len(vid) > 0 {
+		vr, err := app.FindRecordById("versions", vid)
+
+		if err == nil {
+			sr, err := app.FindRecordById("scripts", vr.GetString("script"))
+
+			if err == nil && sr.GetString("project") == pr.Id && matchesTargets(app, sr, tgs) {
+				return sr, vr.Id, nil
+			}
+		}
+	}
+
+	sr, err := resolveScript(app, pr, kr, pm, tgs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return sr, sr.GetString("version"), nil
+}
+
+// Pick the version of a library module the key should load, checking it like the script itself.
+// NB: Modules are linked to a build directly, so they are checked instead of resolved through the targets.
+func pickModule(app *pocketbase.PocketBase, pr *Project, kr *Key, pm *Permissions, mr *core.Record) (string, error) {
+	vid := mr.GetString("version")
+
+	if mr.GetString("project") != pr.Id {
+		return vid, errors.New("a module of this script belongs to another project")
+	}
+
+	if mr.GetBool("rolledBack") {
+		return vid, errors.New("a module of this script was rolled back")
+	}
+
+	channel := mr.GetString("channel")
+
+	if !pm.AllowsChannel(channel) {
+		return vid, errors.New("your role can not load a module of this script")
+	}
+
+	if len(channel) > 0 && channel != CHANNEL_STABLE && channel != keyChannel(kr, pm) {
+		return vid, errors.New("a module of this script is not released to your channel")
+	}
+
+	if !inRollout(kr, mr) {
+		return vid, errors.New("a module of this script is not rolled out to you yet")
+	}
+
+	if pin := pinnedVersion(kr, pm); len(pin) > 0 {
+		if vr, err := app.FindRecordById("versions", pin); err == nil && vr.GetString("script") == mr.Id {
+			return vr.Id, nil
+		}
+	}
+
+	return vid, nil
+}
+
+// Reject updates to versions, they're immutable once created.
+func protectVersion(e *core.RecordEvent) error {
+	return errors.New("versions are immutable")
+}
+
+// Register the version diff endpoint for superusers.
+func bindVersionDiff(app *pocketbase.PocketBase, se *core.ServeEvent) {
+	se.Router.GET("/versions/diff", func(e *core.RequestEvent) error {
+		query := e.Request.URL.Query()
+
+		from, err := app.FindRecordById("versions", query.Get("from"))
+		if err != nil {
+			return apis.NewNotFoundError("from version not found", err)
+		}
+
+		to, err := app.FindRecordById("versions", query.Get("to"))
+		if err != nil {
+			return apis.NewNotFoundError("to version not found", err)
+		}
+
+		changes := map[string][2]any{}
+
+		for _, field := range versionFields {
+			if from.GetString(field) != to.GetString(field) {
+				changes[field] = [2]any{from.Get(field), to.Get(field)}
+			}
+		}
+
+		return e.JSON(http.StatusOK, map[string]any{
+			"from":       from.Id,
+			"to":         to.Id,
+			"created":    [2]any{from.Get("created"), to.Get("created")},
+			"sameSource": from.GetString("sourceHash") == to.GetString("sourceHash"),
+			"changes":    changes,
+		})
+	}).Bind(apis.RequireSuperuserAuth())
+}
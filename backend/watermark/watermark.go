@@ -0,0 +1,303 @@
+package watermark
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"regexp"
+	"strconv"
+)
+
+// Amount of bits in a mark.
+const MARK_BITS = 64
+
+// Largest integer literal that is re-encoded, anything above it might lose precision as a double.
+const MAX_LITERAL uint64 = 1 << 53
+
+// Amount of differing bits between the marker and the literals before they count as disagreeing.
+// NB: Edits flip a few bits of the literal mark, a swapped marker differs in about half of them.
+const MARKER_TOLERANCE int = 8
+
+// Marker statement prepended to watermarked sources.
+// NB: It survives reformatting but is trivial to strip or swap, the numeric literals are what tracing relies on.
+const MARKER_FORMAT = "local _ = \"asb:%016x\"\n"
+
+var markerPattern = regexp.MustCompile(`"asb:([0-9a-f]{16})"`)
+
+// Result of extracting a mark from a source.
+type Result struct {
+	// Mark recovered from the numeric literals by majority vote.
+	Mark uint64
+
+	// Amount of integer literals that voted, and the positions of the mark that got at least one vote.
+	Literals int
+	Covered  int
+
+	// Bits of the mark that got at least one vote, the others are zero in 'Mark' without saying anything.
+	Mask uint64
+
+	// Mark of the string marker.
+	// NB: Only valid if 'Marked' is set.
+	Marked bool
+	Marker uint64
+}
+
+// Check if the string marker disagrees with the mark of the literals, which means it was likely edited.
+func (res *Result) Disagrees() bool {
+	return res.Marked && res.Covered > 0 && res.Distance(res.Marker) > MARKER_TOLERANCE
+}
+
+// Amount of covered bits in which a mark differs from the one of the literals.
+// NB: Uncovered bits would add about half their count to every mark and bury the real one in short sources.
+func (res *Result) Distance(mark uint64) int {
+	return bits.OnesCount64((res.Mark ^ mark) & res.Mask)
+}
+
+// Derive a mark from a secret and the parts it identifies, like a key id and a subscription id.
+func Derive(secret []byte, parts ...string) uint64 {
+	mac := hmac.New(sha256.New, secret)
+
+	for _, part := range parts {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+
+	return binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+}
+
+// Amount of differing bits between two marks.
+func Distance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// A span of an integer literal in a source.
+type literal struct {
+	start int
+	end   int
+	value uint64
+	hex   bool
+
+	// Identifier before the literal, and the amount of literals between them.
+	word string
+	run  int
+}
+
+// Position of the mark a literal carries, from it's value and the identifier before it.
+// NB: Whitespace and literals elsewhere don't change it, so reformatting and edits only move the bits they touch.
+func (lit *literal) position() int {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", lit.word, lit.value, lit.run)
+	return int(h.Sum64() % MARK_BITS)
+}
+
+// Skip a long bracket starting at 'i', returning the index after it or -1 if it isn't one.
+func skipLongBracket(src []byte, i int) int {
+	if i >= len(src) || src[i] != '[' {
+		return -1
+	}
+
+	level := 0
+	j := i + 1
+
+	for j < len(src) && src[j] == '=' {
+		level++
+		j++
+	}
+
+	if j >= len(src) || src[j] != '[' {
+		return -1
+	}
+
+	closing := append(append([]byte{']'}, bytes.Repeat([]byte{'='}, level)...), ']')
+	end := bytes.Index(src[j+1:], closing)
+
+	if end < 0 {
+		return len(src)
+	}
+
+	return j + 1 + end + len(closing)
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Find every plain integer literal of a Lua source, skipping comments, strings and identifiers.
+func literals(src []byte) []literal {
+	lits := []literal{}
+
+	word := ""
+	run := 0
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == '-' && i+1 < len(src) && src[i+1] == '-':
+			if end := skipLongBracket(src, i+2); end >= 0 {
+				i = end
+				continue
+			}
+
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+
+		case c == '[':
+			if end := skipLongBracket(src, i); end >= 0 {
+				i = end
+				continue
+			}
+
+			i++
+
+		case c == '"' || c == '\'' || c == '`':
+			i++
+
+			for i < len(src) && src[i] != c && src[i] != '\n' {
+				if src[i] == '\\' {
+					i++
+				}
+
+				i++
+			}
+
+			i++
+
+		case isIdent(c) && !isDigit(c):
+			start := i
+
+			for i < len(src) && isIdent(src[i]) {
+				i++
+			}
+
+			word = string(src[start:i])
+			run = 0
+
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			hex := c == '0' && i+1 < len(src) && (src[i+1] == 'x' || src[i+1] == 'X')
+
+			if hex {
+				i += 2
+			}
+
+			for i < len(src) {
+				d := src[i]
+
+				if isIdent(d) || d == '.' {
+					i++
+					continue
+				}
+
+				// Exponent signs belong to the literal.
+				if (d == '+' || d == '-') && !hex && (src[i-1] == 'e' || src[i-1] == 'E') {
+					i++
+					continue
+				}
+
+				break
+			}
+
+			text := string(src[start:i])
+
+			var value uint64
+			var err error
+
+			if hex {
+				value, err = strconv.ParseUint(text[2:], 16, 64)
+			} else {
+				value, err = strconv.ParseUint(text, 10, 64)
+			}
+
+			if err == nil && value <= MAX_LITERAL {
+				lits = append(lits, literal{start: start, end: i, value: value, hex: hex, word: word, run: run})
+				run++
+			}
+
+		default:
+			i++
+		}
+	}
+
+	return lits
+}
+
+// Embed a mark into a Lua source.
+// Every integer literal carries one bit of the mark in it's form, decimal for a zero and hexadecimal for a one.
+// NB: The mark repeats over the literals, so extracting it survives reformatting and partial edits.
+func Embed(src []byte, mark uint64) []byte {
+	var out bytes.Buffer
+	out.Grow(len(src) + len(src)/8)
+
+	fmt.Fprintf(&out, MARKER_FORMAT, mark)
+
+	last := 0
+
+	for _, lit := range literals(src) {
+		out.Write(src[last:lit.start])
+
+		if (mark>>lit.position())&1 == 1 {
+			fmt.Fprintf(&out, "0x%X", lit.value)
+		} else {
+			out.WriteString(strconv.FormatUint(lit.value, 10))
+		}
+
+		last = lit.end
+	}
+
+	out.Write(src[last:])
+
+	return out.Bytes()
+}
+
+// Extract the mark of a watermarked Lua source.
+func Extract(src []byte) Result {
+	var res Result
+
+	if match := markerPattern.FindSubmatch(src); match != nil {
+		if marker, err := strconv.ParseUint(string(match[1]), 16, 64); err == nil {
+			res.Marked = true
+			res.Marker = marker
+
+			// NB: Literals before the first identifier of the source would otherwise follow the marker's.
+			src = bytes.Replace(src, []byte(fmt.Sprintf(MARKER_FORMAT, marker)), nil, 1)
+		}
+	}
+
+	var ones, votes [MARK_BITS]int
+
+	for _, lit := range literals(src) {
+		pos := lit.position()
+		votes[pos]++
+
+		if lit.hex {
+			ones[pos]++
+		}
+
+		res.Literals++
+	}
+
+	for pos := 0; pos < MARK_BITS; pos++ {
+		if votes[pos] <= 0 {
+			continue
+		}
+
+		res.Covered++
+		res.Mask |= 1 << pos
+
+		if ones[pos]*2 > votes[pos] {
+			res.Mark |= 1 << pos
+		}
+	}
+
+	return res
+}
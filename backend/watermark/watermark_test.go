@@ -0,0 +1,79 @@
+package watermark
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testMark uint64 = 0xA5C3_0F96_1E2D_7B48
+
+// A source with enough literals after enough identifiers to cover every bit of a mark.
+func testSource() string {
+	var b strings.Builder
+
+	b.WriteString("-- 1 2 3 in a comment\n")
+
+	for idx := range 200 {
+		fmt.Fprintf(&b, "local value%d = { %d, %d, \"%d\" }\n", idx, idx, idx*7+1, idx)
+		fmt.Fprintf(&b, "if value%d[1] > %d then\n\treturn %d\nend\n", idx, idx%13, idx*3)
+	}
+
+	return b.String()
+}
+
+// Extract a mark and fail if it isn't within 'tolerance' bits of the embedded one.
+func expectMark(t *testing.T, src string, tolerance int) Result {
+	t.Helper()
+
+	res := Extract([]byte(src))
+	if res.Covered < MARK_BITS {
+		t.Fatalf("literals covered %d/%d bits", res.Covered, MARK_BITS)
+	}
+
+	if d := Distance(res.Mark, testMark); d > tolerance {
+		t.Fatalf("extracted %016x, want %016x (%d bits off)", res.Mark, testMark, d)
+	}
+
+	return res
+}
+
+func TestRoundTrip(t *testing.T) {
+	res := expectMark(t, string(Embed([]byte(testSource()), testMark)), 0)
+
+	if !res.Marked || res.Marker != testMark || res.Disagrees() {
+		t.Fatalf("marker %016x (%t), disagrees %t", res.Marker, res.Marked, res.Disagrees())
+	}
+}
+
+func TestReformat(t *testing.T) {
+	src := string(Embed([]byte(testSource()), testMark))
+
+	// Change the indentation, blank lines and spacing around every statement.
+	src = strings.NewReplacer("\n", "\n\n    ", "\t", "  ", " = ", "=", ", ", ",\n", "{ ", "{", " }", "}").Replace(src)
+
+	expectMark(t, src, 0)
+}
+
+func TestEdit(t *testing.T) {
+	lines := strings.Split(string(Embed([]byte(testSource()), testMark)), "\n")
+
+	// Insert literals near the top and drop a few statements further down.
+	edited := append([]string{}, lines[:10]...)
+	edited = append(edited, "local inserted = { 4, 5, 6, 7 }", "print(42, 43)")
+	edited = append(edited, lines[10:300]...)
+	edited = append(edited, lines[320:]...)
+
+	expectMark(t, strings.Join(edited, "\n"), 0)
+}
+
+func TestSwappedMarker(t *testing.T) {
+	src := string(Embed([]byte(testSource()), testMark))
+	src = strings.Replace(src, fmt.Sprintf("asb:%016x", testMark), fmt.Sprintf("asb:%016x", ^testMark), 1)
+
+	res := expectMark(t, src, 0)
+
+	if !res.Marked || !res.Disagrees() {
+		t.Fatalf("swapped marker %016x wasn't reported as disagreeing", res.Marker)
+	}
+}
@@ -2,7 +2,8 @@
 ---| '0' During or after bootstrapping has been finished
 ---| '1' Waiting for the handshake process to be finished
 ---| '2' Waiting for the identification process to be finished
----| '3' During or after the client loading process has been finished
+---| '3' Waiting for the function checks to be finished
+---| '4' During or after the client loading process has been finished
 
 ---@class connection_data
 ---@field data_listeners function[]
@@ -12,11 +13,15 @@
 ---@field messages message[]
 ---@field closing boolean
 ---@field closed boolean
+---@field freeze_threshold number
 ---@field handshake_stage_handler handshake_stage_handler
 ---@field current_stage client_stage
 ---@field stage_handler stage_handler
 ---@field lycoris_init table|nil
 ---@field script_function function|nil
+---@field script_id string|nil
+---@field version_id string|nil
+---@field chunk_stage_handler chunk_stage_handler|nil
 -- this class specifies the structure for connection data
 local connection_data = {}
 
@@ -141,6 +146,14 @@ function connection_data:handle_packet(data)
 		return self.key_update_stage_handler and self.key_update_stage_handler:handle_packet(self, pk)
 	end
 
+	if pk.Id == 8 then
+		return self.attest_stage_handler and self.attest_stage_handler:handle_packet(self, pk)
+	end
+
+	if pk.Id == 9 then
+		return self.chunk_stage_handler and self.chunk_stage_handler:handle_packet(self, pk)
+	end
+
 	if pk.Id ~= self.stage_handler:handle_packet_id() then
 		return self:disconnect("packet mismatch (%i vs. %i)", pk.Id, self.stage_handler:handle_packet_id())
 	end
@@ -180,6 +193,7 @@ function connection_data.new(default_stage, default_stage_handler)
 	self.key_update_listeners = {}
 	self.closing = false
 	self.closed = false
+	self.freeze_threshold = 5
 	self.current_stage = default_stage
 	self.stage_handler = default_stage_handler
 	self.handshake_stage_handler = nil
@@ -6,6 +6,9 @@
 ---| '4' Connection is closing and we are being sent a reason
 ---| '5' Key data is being updated
 ---| '6' Freeze detected packet
+---| '7' Function integrity probes and their results
+---| '8' Attestation challenge and it's answer
+---| '9' Streamed script chunks and their requests
 
 ---@class packet
 ---@field Id packet_id
@@ -9,8 +9,8 @@ local logger = require("lib.logger")
 -- finish establishing the SWS tunnel
 local analytics_stage_handler = setmetatable({}, { __index = stage_handler })
 
----@module lib.stage_handlers.load_stage_handler
-local load_stage_handler = require("lib.stage_handlers.load_stage_handler")
+---@module lib.stage_handlers.function_check_stage_handler
+local function_check_stage_handler = require("lib.stage_handlers.function_check_stage_handler")
 
 ---analytics stage handler's packet handler
 ---@param conn_data connection_data
@@ -23,19 +23,16 @@ function analytics_stage_handler:handle_packet(conn_data, pk)
 		return
 	end
 
-	logger.warn("setting up loading stage")
+	logger.warn("setting up function check stage")
 
-	conn_data.stage_handler = load_stage_handler.new(self)
+	conn_data.stage_handler = function_check_stage_handler.new(self)
 	conn_data:set_client_stage(3)
 
-	logger.warn("requesting loading for universe id %i", game.GameId)
-
 	self.current_role = analytics_msg["CurrentRole"]
-	self.handshake_stage_handler:send_message(conn_data, 3, {
-		["GameId"] = game.GameId,
-	})
+	self.current_permissions = analytics_msg["Permissions"]
+	conn_data.freeze_threshold = analytics_msg["FreezeThreshold"] or conn_data.freeze_threshold
 
-	logger.warn("finished request - waiting for load")
+	logger.warn("waiting for function checks")
 end
 
 ---analytics stage handler's packet id
@@ -0,0 +1,78 @@
+---@module lib.stage_handlers.stage_handler
+local stage_handler = require("lib.stage_handlers.stage_handler")
+
+---@class attest_stage_handler: stage_handler
+---@field handshake_stage_handler handshake_stage_handler
+-- answer the server's attestation challenges
+local attest_stage_handler = setmetatable({}, { __index = stage_handler })
+
+---@module lib.digest.sha2_256
+local sha2_256 = require("lib.digest.sha2_256")
+
+---@module lib.lockbox.stream
+local stream = require("lib.lockbox.stream")
+
+---@module lib.mac.hmac
+local hmac = require("lib.mac.hmac")
+
+---@module lib.logger
+local logger = require("lib.logger")
+
+-- cached functions
+local os_date, bit32_band = os.date, bit32.band
+
+---@alias attest_field
+---| '1' Subscription id
+---| '2' Loaded script id
+---| '4' Base timestamp
+
+---attest stage handler's packet handler
+---@param conn_data connection_data
+---@param pk packet
+function attest_stage_handler:handle_packet(conn_data, pk)
+	local attest_msg = self.handshake_stage_handler:unmarshal_one(conn_data, pk.Msg)
+	if not attest_msg then
+		return
+	end
+
+	local boot_stage_handler = self.handshake_stage_handler.boot_stage_handler
+	local fields = attest_msg["Fields"]
+	local mac_object = hmac.new(64, sha2_256, self.handshake_stage_handler.hmac_key)
+
+	mac_object:update(stream.from_array(attest_msg["Nonce"]))
+	mac_object:update(stream.from_array({ fields }))
+
+	if bit32_band(fields, 1) ~= 0 then
+		mac_object:update(stream.from_array(boot_stage_handler.subscription_id))
+	end
+
+	if bit32_band(fields, 2) ~= 0 then
+		mac_object:update(stream.from_string(conn_data.script_id))
+	end
+
+	if bit32_band(fields, 4) ~= 0 then
+		mac_object:update(stream.from_string(os_date("!%Y-%m-%dT%H:%M:%SZ", boot_stage_handler.timestamp)))
+	end
+
+	logger.warn("answering attestation challenge (%i)", fields)
+
+	self.handshake_stage_handler:send_message(conn_data, 8, {
+		["Nonce"] = attest_msg["Nonce"],
+		["Mac"] = mac_object:finish():as_bytes(),
+	})
+end
+
+---new attest stage handler object
+---@param handshake_stage_handler handshake_stage_handler
+---@return attest_stage_handler
+function attest_stage_handler.new(handshake_stage_handler)
+	-- create new attest stage handler object
+	local self = setmetatable(stage_handler.new(), { __index = attest_stage_handler })
+	self.handshake_stage_handler = handshake_stage_handler
+
+	-- return new attest stage handler object
+	return self
+end
+
+-- return attest stage handler module
+return attest_stage_handler
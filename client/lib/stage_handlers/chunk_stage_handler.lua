@@ -0,0 +1,228 @@
+---@module lib.stage_handlers.stage_handler
+local stage_handler = require("lib.stage_handlers.stage_handler")
+
+---@class chunk_download
+---@field module table
+---@field chunks string[]
+---@field received number
+---@field requested number
+---@field retries number
+---@field module_function function|nil
+
+---@class chunk_stage_handler: stage_handler
+---@field handshake_stage_handler handshake_stage_handler
+---@field downloads table<string, chunk_download>
+---@field queue chunk_download[]
+---@field remaining number
+---@field on_complete function
+-- download streamed script modules in chunks
+local chunk_stage_handler = setmetatable({}, { __index = stage_handler })
+
+---@module lib.digest.sha2_256
+local sha2_256 = require("lib.digest.sha2_256")
+
+---@module lib.lockbox.stream
+local stream = require("lib.lockbox.stream")
+
+---@module lib.logger
+local logger = require("lib.logger")
+
+-- cached functions
+local table_concat, table_remove, load_string = table.concat, table.remove, loadstring
+
+-- maximum chunks requested at once, the server caps this as well
+-- downloads run one after another, so this is also the most chunks in flight
+local CHUNK_WINDOW = 4
+
+-- maximum retries of a chunk that failed it's integrity check
+local CHUNK_RETRIES = 3
+
+---compare two digests
+---@param left number[]
+---@param right number[]
+---@return boolean
+local function digest_equals(left, right)
+	if #left ~= #right then
+		return false
+	end
+
+	for idx = 1, #left do
+		if left[idx] ~= right[idx] then
+			return false
+		end
+	end
+
+	return true
+end
+
+---digest of a string
+---@param data string
+---@return number[]
+local function digest_string(data)
+	return sha2_256.new():update(stream.from_string(data)):finish():as_bytes()
+end
+
+---request the next window of a download, starting at the first missing chunk
+---@param conn_data connection_data
+---@param download chunk_download
+function chunk_stage_handler:request(conn_data, download)
+	local index = 0
+
+	while download.chunks[index] do
+		index = index + 1
+	end
+
+	download.requested = index + CHUNK_WINDOW
+
+	self.handshake_stage_handler:send_message(conn_data, 9, {
+		["ScriptId"] = download.module["ScriptId"],
+		["Index"] = index,
+		["Count"] = CHUNK_WINDOW,
+	})
+end
+
+---start the next queued download
+---@param conn_data connection_data
+function chunk_stage_handler:next(conn_data)
+	local download = table_remove(self.queue, 1)
+	if not download then
+		return
+	end
+
+	if download.module["Chunks"] <= 0 then
+		return self:finish(conn_data, download)
+	end
+
+	self:request(conn_data, download)
+end
+
+---start downloading, one module after another
+---@param conn_data connection_data
+function chunk_stage_handler:start(conn_data)
+	if self.remaining <= 0 then
+		return self.on_complete()
+	end
+
+	self:next(conn_data)
+end
+
+---assemble, verify and compile a finished download
+---@param conn_data connection_data
+---@param download chunk_download
+function chunk_stage_handler:finish(conn_data, download)
+	local parts = {}
+
+	for idx = 0, download.module["Chunks"] - 1 do
+		parts[#parts + 1] = download.chunks[idx]
+	end
+
+	local payload = table_concat(parts)
+
+	if #payload ~= download.module["Size"] or not digest_equals(digest_string(payload), download.module["Digest"]) then
+		return conn_data:disconnect("streamed module %s failed it's integrity check", download.module["ScriptId"])
+	end
+
+	local module_function = load_string(payload)
+	if not module_function then
+		return conn_data:disconnect("streamed module %s failed to compile", download.module["ScriptId"])
+	end
+
+	download.module_function = module_function
+	download.chunks = {}
+
+	self.remaining = self.remaining - 1
+
+	logger.warn("streamed module %s (%i bytes)", download.module["ScriptId"], #payload)
+
+	if self.remaining <= 0 then
+		return self.on_complete()
+	end
+
+	self:next(conn_data)
+end
+
+---chunk stage handler's packet handler
+---@param conn_data connection_data
+---@param pk packet
+function chunk_stage_handler:handle_packet(conn_data, pk)
+	local chunk_msg = self.handshake_stage_handler:unmarshal_one(conn_data, pk.Msg)
+	if not chunk_msg then
+		return
+	end
+
+	local download = self.downloads[chunk_msg["ScriptId"]]
+	if not download or download.module_function then
+		return
+	end
+
+	local index = chunk_msg["Index"]
+
+	if index >= download.module["Chunks"] or chunk_msg["Total"] ~= download.module["Chunks"] then
+		return conn_data:disconnect("chunk out of range (%i)", index)
+	end
+
+	-- drop the corrupted chunk and resume from it
+	if not digest_equals(digest_string(chunk_msg["Data"]), chunk_msg["Digest"]) then
+		download.retries = download.retries + 1
+
+		if download.retries > CHUNK_RETRIES then
+			return conn_data:disconnect("chunk failed it's integrity check (%i)", index)
+		end
+
+		logger.warn("chunk failed it's integrity check (%i)", index)
+
+		return index == download.requested - 1 and self:request(conn_data, download)
+	end
+
+	if not download.chunks[index] then
+		download.chunks[index] = chunk_msg["Data"]
+		download.received = download.received + 1
+	end
+
+	if download.received >= download.module["Chunks"] then
+		return self:finish(conn_data, download)
+	end
+
+	-- the window ended, ask for the next one
+	if index >= download.requested - 1 or index >= download.module["Chunks"] - 1 then
+		self:request(conn_data, download)
+	end
+end
+
+---new chunk stage handler object
+---@param handshake_stage_handler handshake_stage_handler
+---@param modules table[]
+---@param on_complete function
+---@return chunk_stage_handler
+function chunk_stage_handler.new(handshake_stage_handler, modules, on_complete)
+	-- create new chunk stage handler object
+	local self = setmetatable(stage_handler.new(), { __index = chunk_stage_handler })
+	self.handshake_stage_handler = handshake_stage_handler
+	self.downloads = {}
+	self.queue = {}
+	self.remaining = 0
+	self.on_complete = on_complete
+
+	for _, module in next, modules do
+		if module["Streamed"] then
+			local download = {
+				module = module,
+				chunks = {},
+				received = 0,
+				requested = 0,
+				retries = 0,
+				module_function = nil,
+			}
+
+			self.downloads[module["ScriptId"]] = download
+			self.queue[#self.queue + 1] = download
+			self.remaining = self.remaining + 1
+		end
+	end
+
+	-- return new chunk stage handler object
+	return self
+end
+
+-- return chunk stage handler module
+return chunk_stage_handler
@@ -0,0 +1,152 @@
+---@module lib.stage_handlers.stage_handler
+local stage_handler = require("lib.stage_handlers.stage_handler")
+
+---@class function_check_stage_handler: stage_handler
+---@field analytics_stage_handler analytics_stage_handler
+-- answer the server's function integrity probes
+local function_check_stage_handler = setmetatable({}, { __index = stage_handler })
+
+---@module lib.stage_handlers.load_stage_handler
+local load_stage_handler = require("lib.stage_handlers.load_stage_handler")
+
+---@module lib.networking.function_check_data
+local function_check_data = require("lib.networking.function_check_data")
+
+---@module lib.logger
+local logger = require("lib.logger")
+
+-- cached functions
+local lua_pcall, debug_info, debug_getinfo, type_of, string_split, table_sort, lua_tostring, is_c_closure =
+	pcall, debug.info, debug.getinfo, typeof, string.split, table.sort, tostring, iscclosure
+
+---@alias probe_kind
+---| '0' Name of the function
+---| '1' Amount of upvalues
+---| '2' Is the function a C closure
+---| '3' Shape of 'debug.getinfo'
+---| '4' Source, line and arity of the function
+
+---resolve a dotted function path from the global environment
+---@param path string
+---@return function|nil
+local function resolve_function(path)
+	local current = getrenv and getrenv() or getfenv(0)
+
+	for _, part in next, string_split(path, ".") do
+		if type_of(current) ~= "table" then
+			return nil
+		end
+
+		current = current[part]
+	end
+
+	return type_of(current) == "function" and current or nil
+end
+
+---run a probe against a function
+---@param func function
+---@param kind probe_kind
+---@return function_check_data
+local function run_probe(func, kind)
+	if kind == 0 then
+		return function_check_data.str(debug_info(func, "n") or "")
+	end
+
+	if kind == 1 then
+		local info = debug_getinfo(func)
+		return function_check_data.byte(info and info.nups or 0)
+	end
+
+	if kind == 2 then
+		return function_check_data.bool(is_c_closure and is_c_closure(func) or false)
+	end
+
+	if kind == 3 then
+		local shape = {}
+
+		for key, value in next, debug_getinfo(func) or {} do
+			shape[#shape + 1] = lua_tostring(key) .. ":" .. type_of(value)
+		end
+
+		table_sort(shape)
+
+		return function_check_data.str_array(shape)
+	end
+
+	local source, line, arity, vararg = debug_info(func, "sla")
+
+	return function_check_data.info({
+		["Source"] = source,
+		["Line"] = line,
+		["Arity"] = arity,
+		["Vararg"] = vararg,
+	})
+end
+
+---function check stage handler's packet handler
+---@param conn_data connection_data
+---@param pk packet
+function function_check_stage_handler:handle_packet(conn_data, pk)
+	local handshake_stage_handler = self.analytics_stage_handler.handshake_stage_handler
+
+	local check_msg = handshake_stage_handler:unmarshal_one(conn_data, pk.Msg)
+	if not check_msg then
+		return
+	end
+
+	local results = {}
+
+	for _, probe in next, check_msg["Probes"] or {} do
+		local func = resolve_function(probe["Function"])
+		local success, result = lua_pcall(run_probe, func, probe["Kind"])
+
+		if func and success then
+			results[#results + 1] = { ["Id"] = probe["Id"], ["Data"] = result }
+		end
+	end
+
+	logger.warn("answering function checks (%i)", #(check_msg["Probes"] or {}))
+
+	handshake_stage_handler:send_message(conn_data, 7, {
+		["Results"] = results,
+	})
+
+	conn_data.stage_handler = load_stage_handler.new(self.analytics_stage_handler)
+	conn_data:set_client_stage(4)
+
+	logger.warn("requesting loading for universe id %i", game.GameId)
+
+	handshake_stage_handler:send_message(conn_data, 3, {
+		["GameId"] = game.GameId,
+		["PlaceId"] = game.PlaceId,
+	})
+
+	logger.warn("finished request - waiting for load")
+end
+
+---function check stage handler's packet id
+---@return packet_id
+function function_check_stage_handler:handle_packet_id()
+	return 7
+end
+
+---function check stage handler's client stage
+---@return client_stage
+function function_check_stage_handler:handle_client_stage()
+	return 3
+end
+
+---new function check stage handler object
+---@param analytics_stage_handler analytics_stage_handler
+---@return function_check_stage_handler
+function function_check_stage_handler.new(analytics_stage_handler)
+	-- create new function check stage handler object
+	local self = setmetatable(stage_handler.new(), { __index = function_check_stage_handler })
+	self.analytics_stage_handler = analytics_stage_handler
+
+	-- return new function check stage handler object
+	return self
+end
+
+-- return function check stage handler module
+return function_check_stage_handler
@@ -20,6 +20,11 @@ function key_update_stage_handler:handle_packet(conn_data, pk)
 
 	conn_data.lycoris_init.current_role = key_update_msg["Role"]
 
+	if conn_data.armorshield then
+		conn_data.armorshield.current_role = key_update_msg["Role"]
+		conn_data.armorshield.current_permissions = key_update_msg["Permissions"]
+	end
+
 	logger.warn("key update (%s) to (%i) listeners", key_update_msg["Role"], #conn_data.key_update_listeners)
 
 	for _, listener in next, conn_data.key_update_listeners do
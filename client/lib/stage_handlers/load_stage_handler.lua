@@ -9,14 +9,27 @@ local load_stage_handler = setmetatable({}, { __index = stage_handler })
 ---@module lib.stage_handlers.key_update_stage_handler
 local key_update_stage_handler = require("lib.stage_handlers.key_update_stage_handler")
 
+---@module lib.stage_handlers.chunk_stage_handler
+local chunk_stage_handler = require("lib.stage_handlers.chunk_stage_handler")
+
+---@module lib.stage_handlers.attest_stage_handler
+local attest_stage_handler = require("lib.stage_handlers.attest_stage_handler")
+
 -- cached functions
 local get_function_env, task_defer, new_proxy, get_metatable, type_of, lua_error, os_clock =
 	getfenv, task.defer, newproxy, getmetatable, typeof, error, os.clock
+local load_string, base64_decode = loadstring, base64.decode
 
 ---@module lib.logger
 local logger = require("lib.logger")
 
----@compile_time: script's source as a function
+---@module lib.cipher.rc4
+local rc4 = require("lib.cipher.rc4")
+
+---@module lib.utility
+local utility = require("lib.utility")
+
+---@compile_time: script's source sealed as { seal id, base64 of the sealed source }
 local SCRIPT_FUNCTIONS = {}
 
 -- start timestamp
@@ -33,6 +46,22 @@ local function create_script_export(conn_data, func)
 	end)
 end
 
+---unseal an embedded script with the key the server released for it's seal
+---@param unseal_keys table<string, number[]>
+---@param sealed table
+---@return function|nil
+local function unseal_script(unseal_keys, sealed)
+	local unseal_key = unseal_keys[sealed[1]]
+	if not unseal_key then
+		return nil
+	end
+
+	local rc4_object = rc4.new(unseal_key)
+	local source = utility.to_string(rc4_object:run(utility.to_byte_array(base64_decode(sealed[2]))))
+
+	return load_string(source)
+end
+
 ---armorshield export to listen for role changes
 ---@param conn_data connection_data
 ---@param func function
@@ -57,7 +86,11 @@ function load_stage_handler:handle_packet(conn_data, pk)
 
 	logger.warn("processing and loading script")
 
-	local armorshield = { key = script_key, current_role = self.analytics_stage_handler.current_role }
+	local armorshield = {
+		key = script_key,
+		current_role = self.analytics_stage_handler.current_role,
+		current_permissions = self.analytics_stage_handler.current_permissions,
+	}
 	armorshield.add_key_update_listener = create_script_export(conn_data, add_key_update_listener)
 
 	local safe_exports = new_proxy(true)
@@ -67,15 +100,60 @@ function load_stage_handler:handle_packet(conn_data, pk)
 		return armorshield[idx]
 	end)
 
-	local load_function = SCRIPT_FUNCTIONS[load_msg["ScriptId"]]
-	get_function_env(load_function).armorshield = safe_exports
+	-- modules are ran in order, libraries first and the script itself last
+	local modules = load_msg["Modules"] or { { ["ScriptId"] = load_msg["ScriptId"] } }
+
+	local unseal_keys = load_msg["UnsealKeys"] or {}
+	local embedded_functions = {}
+
+	for _, module in next, modules do
+		local sealed = not module["Streamed"] and SCRIPT_FUNCTIONS[module["ScriptId"]]
+
+		if not module["Streamed"] and not sealed then
+			return logger.fatal("missing script module %s", module["ScriptId"])
+		end
+
+		if sealed then
+			embedded_functions[module["ScriptId"]] = unseal_script(unseal_keys, sealed)
 
-	conn_data.script_function = load_function
+			if not embedded_functions[module["ScriptId"]] then
+				return logger.fatal("failed to unseal script module %s", module["ScriptId"])
+			end
+		end
+	end
+
+	local handshake_stage_handler = self.analytics_stage_handler.handshake_stage_handler
+
+	-- streamed modules are compiled once all of them finished downloading
+	conn_data.chunk_stage_handler = chunk_stage_handler.new(handshake_stage_handler, modules, function()
+		local module_functions = {}
+
+		for _, module in next, modules do
+			local download = conn_data.chunk_stage_handler.downloads[module["ScriptId"]]
+			local module_function = download and download.module_function or embedded_functions[module["ScriptId"]]
+
+			get_function_env(module_function).armorshield = safe_exports
+			module_functions[#module_functions + 1] = module_function
+		end
+
+		conn_data.script_function = function()
+			for _, module_function in next, module_functions do
+				module_function()
+			end
+		end
+
+		logger.warn("script loaded in %.2f seconds", os_clock() - start_timestamp)
+	end)
+
+	conn_data.script_id = load_msg["ScriptId"]
+	conn_data.version_id = load_msg["VersionId"]
 	conn_data.armorshield = armorshield
-	conn_data.key_update_stage_handler =
-		key_update_stage_handler.new(self.analytics_stage_handler.handshake_stage_handler)
+	conn_data.key_update_stage_handler = key_update_stage_handler.new(handshake_stage_handler)
+	conn_data.attest_stage_handler = attest_stage_handler.new(handshake_stage_handler)
+
+	logger.warn("processed load data with role %s", armorshield.current_role)
 
-	logger.warn("script loaded in %.2f seconds with role %s", os_clock() - start_timestamp, armorshield.current_role)
+	conn_data.chunk_stage_handler:start(conn_data)
 end
 
 ---load stage handler's packet id
@@ -87,7 +165,7 @@ end
 ---load stage handler's client stage
 ---@return client_stage
 function load_stage_handler:handle_client_stage()
-	return 3
+	return 4
 end
 
 ---new load stage handler object
@@ -174,8 +174,8 @@ local function handler_loop(last_waited)
 	handle_packets()
 	handle_close()
 
-	-- Freeze and it's over 5 seconds? Improbable. Probably trying to dump the script and froze the Roblox.
-	if conn_data.handshake_stage_handler and last_waited >= 5 then
+	-- Freeze and it's over the threshold? Improbable. Probably trying to dump the script and froze the Roblox.
+	if conn_data.handshake_stage_handler and last_waited >= conn_data.freeze_threshold then
 		conn_data.handshake_stage_handler:send_message(conn_data, 6, {
 			["Seconds"] = last_waited,
 		})
@@ -1,4 +1,5 @@
-use darklua_core::{nodes::{Block, Expression, FunctionExpression, HexNumber, LocalAssignStatement, NumberExpression, StringExpression, TableEntry, TableIndexEntry}, process::{DefaultVisitor, NodeProcessor, NodeVisitor}, rules::{Context, FlawlessRule}};
+use base64::{prelude::BASE64_STANDARD, Engine};
+use darklua_core::{nodes::{Block, Expression, HexNumber, LocalAssignStatement, NumberExpression, StringExpression, TableEntry, TableExpression, TableIndexEntry}, process::{DefaultVisitor, NodeProcessor, NodeVisitor}, rules::{Context, FlawlessRule}};
 
 const SCRIPT_FUNCTIONS_TBL_IDENTIFIER: &str = "SCRIPT_FUNCTIONS";
 const SALT_TBL_IDENTIFIER: &str = "DB_HDKF_SALT";
@@ -51,10 +52,15 @@ impl NodeProcessor for InlineConstantsProcessor {
         }
     
         if name == SCRIPT_FUNCTIONS_TBL_IDENTIFIER {
-            let func = FunctionExpression::new(self.ic.source.clone(), Vec::new(), true);
+            // { seal id, base64 of the sealed source }
+            let sealed = TableExpression::new(vec![
+                TableEntry::Value(Expression::String(StringExpression::from_value(&self.ic.seal.clone()))),
+                TableEntry::Value(Expression::String(StringExpression::from_value(&BASE64_STANDARD.encode(&self.ic.sealed)))),
+            ]);
+
             table.mutate_entries().push(TableEntry::Index(TableIndexEntry::new(
                 Expression::String(StringExpression::from_value(&self.ic.id.clone())),
-                Expression::Function(func),
+                Expression::Table(sealed),
             )));
         }
     }
@@ -62,15 +68,16 @@ impl NodeProcessor for InlineConstantsProcessor {
 
 #[derive(Debug, Clone, Default, PartialEq, Eq)]
 pub struct InlineConstants {
-    source: Block,
+    sealed: Vec<u8>,
     salt: Vec<u8>,
     point: Vec<u8>,
     id: String,
+    seal: String,
 }
 
 impl InlineConstants {
-    pub fn new(source: Block, salt: Vec<u8>, point: Vec<u8>, id: String) -> Self {
-        Self { source, salt, point, id }
+    pub fn new(sealed: Vec<u8>, salt: Vec<u8>, point: Vec<u8>, id: String, seal: String) -> Self {
+        Self { sealed, salt, point, id, seal }
     }
 }
 
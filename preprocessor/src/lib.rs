@@ -1,60 +1,112 @@
 mod inline_constants;
+mod seal;
 
 extern crate libc;
-use std::{ffi::{CStr, CString}, path::PathBuf, ptr::null};
+use std::{ffi::{CStr, CString}, panic::{self, AssertUnwindSafe}, path::PathBuf, ptr::null};
 use inline_constants::InlineConstants;
 use base64::{prelude::BASE64_STANDARD, Engine};
 use darklua_core::{generator::{LuaGenerator, ReadableLuaGenerator}, rules::{ContextBuilder, FlawlessRule, RemoveComments, RemoveInterpolatedString}, Parser, Resources};
 
-// @todo: mangle all require paths, randomize all fields in tables, and function declarations
-#[no_mangle]
-pub extern "C" fn preprocess(loader: *const libc::c_char, source: *const libc::c_char, salt: *const libc::c_char, point: *const libc::c_char, id: *const libc::c_char) -> *const libc::c_char {
-    let buf_source = unsafe { CStr::from_ptr(source).to_bytes() };
-    let str_source = String::from_utf8(buf_source.to_vec()).unwrap();
+// Read a C string argument, rejecting null pointers and bad UTF-8.
+fn read_arg(arg: *const libc::c_char) -> Option<String> {
+    if arg.is_null() {
+        return None;
+    }
 
-    let buf_loader = unsafe { CStr::from_ptr(loader).to_bytes() };
-    let str_loader = String::from_utf8(buf_loader.to_vec()).unwrap();
+    let buf = unsafe { CStr::from_ptr(arg).to_bytes() };
+    String::from_utf8(buf.to_vec()).ok()
+}
 
-    let buf_salt = unsafe { CStr::from_ptr(salt).to_bytes() };
-    let str_salt = String::from_utf8(buf_salt.to_vec()).unwrap();
+// Preprocess a script body the way it ships, without it's comments.
+fn body(str_source: &str) -> Option<String> {
+    let parser = Parser::default();
+    let mut source_block = parser.parse(str_source).ok()?;
 
-    let buf_point = unsafe { CStr::from_ptr(point).to_bytes() };
-    let str_point = String::from_utf8(buf_point.to_vec()).unwrap();
+    let resources = Resources::from_memory();
+    let source_context = ContextBuilder::new(PathBuf::new(), &resources, str_source).build();
+    RemoveComments::default().flawless_process(&mut source_block, &source_context);
 
-    let buf_id = unsafe { CStr::from_ptr(id).to_bytes() };
-    let str_id = String::from_utf8(buf_id.to_vec()).unwrap();
+    let mut source_generator = ReadableLuaGenerator::new(usize::MAX);
+    source_generator.write_block(&source_block);
 
-    let salt = BASE64_STANDARD.decode(str_salt).unwrap();
-    let point = BASE64_STANDARD.decode(str_point).unwrap();
-    
-    let parser = Parser::default();
-    let source_block = match parser.parse(&str_source) {
-        Ok(block) => block,
-        Err(_) => {
-            return null();
-        }
-    };
+    Some(source_generator.into_string())
+}
 
-    let mut loader_block = match parser.parse(&str_loader) {
-        Ok(block) => block,
-        Err(_) => {
-            return null();
-        }
-    };
+fn protect(loader: *const libc::c_char, source: *const libc::c_char, salt: *const libc::c_char, point: *const libc::c_char, id: *const libc::c_char, seal: *const libc::c_char, key: *const libc::c_char) -> Option<String> {
+    let str_source = read_arg(source)?;
+    let str_loader = read_arg(loader)?;
+    let str_salt = read_arg(salt)?;
+    let str_point = read_arg(point)?;
+    let str_id = read_arg(id)?;
+    let str_seal = read_arg(seal)?;
+    let str_key = read_arg(key)?;
+
+    let salt = BASE64_STANDARD.decode(str_salt).ok()?;
+    let point = BASE64_STANDARD.decode(str_point).ok()?;
+    let key = BASE64_STANDARD.decode(str_key).ok()?;
+
+    if key.is_empty() {
+        return None;
+    }
+
+    let parser = Parser::default();
+    let mut loader_block = parser.parse(&str_loader).ok()?;
 
     let resources = Resources::from_memory();
     let context = ContextBuilder::new(PathBuf::new(), &resources, str_loader.as_str()).build();
-    InlineConstants::new(source_block, salt, point, str_id).flawless_process(&mut loader_block, &context);
+
+    // The script body only ships sealed, the loader has no usable code without the server's key.
+    let sealed = seal::rc4(&key, body(&str_source)?.as_bytes());
+
+    InlineConstants::new(sealed, salt, point, str_id, str_seal).flawless_process(&mut loader_block, &context);
     RemoveComments::default().flawless_process(&mut loader_block, &context);
     RemoveInterpolatedString::default().flawless_process(&mut loader_block, &context);
 
     let mut generator = ReadableLuaGenerator::new(usize::MAX);
     generator.write_block(&loader_block);
-    
-        
+
     let watermark = "-- Protected by ArmorShield <3 Blastbrean\n";
     let notice = "-- This script must be put inside of Luraph or Luarmor for real-world use.\n";
-    let output = format!("{}{}{}", watermark, notice, generator.into_string());
 
-    CString::new(output).unwrap().into_raw()
-}
\ No newline at end of file
+    Some(format!("{}{}{}", watermark, notice, generator.into_string()))
+}
+
+// @todo: mangle all require paths, randomize all fields in tables, and function declarations
+// Returns null on malformed input or a panic, the output must be released with `preprocess_free`.
+#[no_mangle]
+pub extern "C" fn preprocess(loader: *const libc::c_char, source: *const libc::c_char, salt: *const libc::c_char, point: *const libc::c_char, id: *const libc::c_char, seal: *const libc::c_char, key: *const libc::c_char) -> *const libc::c_char {
+    let output = match panic::catch_unwind(AssertUnwindSafe(|| protect(loader, source, salt, point, id, seal, key))) {
+        Ok(Some(output)) => output,
+        _ => return null(),
+    };
+
+    match CString::new(output) {
+        Ok(output) => output.into_raw(),
+        Err(_) => null(),
+    }
+}
+
+// Preprocess a script body for streaming, returns null on malformed input or a panic.
+// The output must be released with `preprocess_free`.
+#[no_mangle]
+pub extern "C" fn preprocess_body(source: *const libc::c_char) -> *const libc::c_char {
+    let output = match panic::catch_unwind(AssertUnwindSafe(|| body(&read_arg(source)?))) {
+        Ok(Some(output)) => output,
+        _ => return null(),
+    };
+
+    match CString::new(output) {
+        Ok(output) => output.into_raw(),
+        Err(_) => null(),
+    }
+}
+
+// Release an output returned by `preprocess` or `preprocess_body`.
+#[no_mangle]
+pub extern "C" fn preprocess_free(output: *mut libc::c_char) {
+    if output.is_null() {
+        return;
+    }
+
+    unsafe { drop(CString::from_raw(output)) };
+}
@@ -0,0 +1,26 @@
+// Seal script bodies with RC4 so the loader can only run them once the server releases the key.
+// NB: This has to stay in sync with the client's `lib.cipher.rc4`.
+pub(crate) fn rc4(key: &[u8], data: &[u8]) -> Vec<u8> {
+    let mut st: [u8; 256] = [0; 256];
+    for (i, v) in st.iter_mut().enumerate() {
+        *v = i as u8;
+    }
+
+    let mut j: u8 = 0;
+    for i in 0..256 {
+        j = j.wrapping_add(st[i]).wrapping_add(key[i % key.len()]);
+        st.swap(i, j as usize);
+    }
+
+    let (mut x, mut y): (u8, u8) = (0, 0);
+    let mut out = Vec::with_capacity(data.len());
+
+    for byte in data {
+        x = x.wrapping_add(1);
+        y = y.wrapping_add(st[x as usize]);
+        st.swap(x as usize, y as usize);
+        out.push(byte ^ st[st[x as usize].wrapping_add(st[y as usize]) as usize]);
+    }
+
+    out
+}